@@ -0,0 +1,67 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gh-efforts/retrieve-server/build"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("admin")
+
+// NewMux returns the mux served on the admin listener. It carries the
+// profiling, metrics and log control endpoints that must not be reachable
+// from the public api listener.
+func NewMux(metrics http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", metrics)
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("GET /admin/version", versionHandle)
+
+	handleLog(mux)
+
+	return mux
+}
+
+// Serve binds the admin listener and serves it in the background until it
+// is shut down. A listener that cannot bind is returned so startup fails
+// instead of running without metrics, profiling and probes.
+func Serve(server *http.Server) error {
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("admin listener: %w", err)
+	}
+	log.Infow("admin listener", "listen", ln.Addr().String())
+
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorw("admin listener", "err", err)
+		}
+	}()
+
+	return nil
+}
+
+type Version struct {
+	Version string `json:"version"`
+}
+
+func versionHandle(w http.ResponseWriter, r *http.Request) {
+	err := json.NewEncoder(w).Encode(Version{Version: build.UserVersion()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	logging "github.com/ipfs/go-log/v2"
+	"go.uber.org/zap/zapcore"
+)
+
+type LogLevel struct {
+	Subsystem string `json:"subsystem"`
+	Level     string `json:"level"`
+}
+
+type LogFormat struct {
+	Format string `json:"format"`
+}
+
+func handleLog(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/log/levels", logLevelsHandle)
+	mux.HandleFunc("POST /admin/log/level", setLogLevelHandle)
+	mux.HandleFunc("POST /admin/log/format", setLogFormatHandle)
+}
+
+func logLevelsHandle(w http.ResponseWriter, r *http.Request) {
+	err := json.NewEncoder(w).Encode(LogLevels())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func setLogLevelHandle(w http.ResponseWriter, r *http.Request) {
+	var ll LogLevel
+	err := json.NewDecoder(r.Body).Decode(&ll)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if ll.Subsystem == "" {
+		ll.Subsystem = "*"
+	}
+	err = logging.SetLogLevel(ll.Subsystem, ll.Level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Infow("set log level", "subsystem", ll.Subsystem, "level", ll.Level)
+}
+
+func setLogFormatHandle(w http.ResponseWriter, r *http.Request) {
+	var lf LogFormat
+	err := json.NewDecoder(r.Body).Decode(&lf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = SetLogFormat(lf.Format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Infow("set log format", "format", lf.Format)
+}
+
+// LogLevels returns the current level of every subsystem, sorted by name.
+func LogLevels() []LogLevel {
+	subsystems := logging.GetSubsystems()
+	sort.Strings(subsystems)
+
+	levels := make([]LogLevel, 0, len(subsystems))
+	for _, name := range subsystems {
+		levels = append(levels, LogLevel{
+			Subsystem: name,
+			Level:     subsystemLevel(name).String(),
+		})
+	}
+	return levels
+}
+
+// subsystemLevel probes the logger since go-log does not expose its levels.
+func subsystemLevel(name string) zapcore.Level {
+	core := logging.Logger(name).Desugar().Core()
+	for lvl := zapcore.DebugLevel; lvl < zapcore.FatalLevel; lvl++ {
+		if core.Enabled(lvl) {
+			return lvl
+		}
+	}
+	return zapcore.FatalLevel
+}
+
+// SetLogFormat switches the output format of all loggers, "color",
+// "nocolor" or "json", the current levels are kept.
+func SetLogFormat(format string) error {
+	cfg := logging.GetConfig()
+	switch strings.ToLower(format) {
+	case "color":
+		cfg.Format = logging.ColorizedOutput
+	case "nocolor", "plaintext":
+		cfg.Format = logging.PlaintextOutput
+	case "json":
+		cfg.Format = logging.JSONOutput
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+
+	cfg.SubsystemLevels = make(map[string]logging.LogLevel)
+	for _, ll := range LogLevels() {
+		lvl, err := logging.LevelFromString(ll.Level)
+		if err != nil {
+			return err
+		}
+		cfg.SubsystemLevels[ll.Subsystem] = lvl
+	}
+
+	logging.SetupLogging(cfg)
+	return nil
+}
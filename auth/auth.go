@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("auth")
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+// Token grants its scopes in every namespace, a scope qualified with a
+// namespace such as "write:ns1" only grants it under /ns/ns1/.
+type Token struct {
+	Token    string
+	Identity string
+	Scopes   []string
+}
+
+func (t *Token) has(scope string, ns string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+		if ns != "" && s == scope+":"+ns {
+			return true
+		}
+	}
+	return false
+}
+
+// namespace returns the namespace of a /ns/{ns}/ path, or "" for paths of
+// the default namespace.
+func namespace(path string) string {
+	rest, ok := strings.CutPrefix(path, "/ns/")
+	if !ok {
+		return ""
+	}
+	ns, _, _ := strings.Cut(rest, "/")
+	return ns
+}
+
+type ctxKey struct{}
+
+// IdentityFromContext returns the identity of the token that authenticated
+// the request, or "" for anonymous requests.
+func IdentityFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+func NewContext(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, identity)
+}
+
+// AdminListener is the identity of requests to the admin listener, which
+// trusts whoever reaches it, so audit entries still name where a change
+// came from.
+const AdminListener = "admin-listener"
+
+// WithIdentity gives requests that have no identity the identity id.
+func WithIdentity(id string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IdentityFromContext(r.Context()) == "" {
+			r = r.WithContext(NewContext(r.Context(), id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Authenticator checks bearer tokens, it lets every request through while
+// no tokens are configured.
+type Authenticator struct {
+	lk            sync.RWMutex
+	tokens        []Token
+	anonymousRead bool
+}
+
+func New(tokens []Token, anonymousRead bool) *Authenticator {
+	return &Authenticator{
+		tokens:        tokens,
+		anonymousRead: anonymousRead,
+	}
+}
+
+// SetTokens replaces the tokens, requests already authenticated keep
+// their identity.
+func (a *Authenticator) SetTokens(tokens []Token, anonymousRead bool) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	a.tokens = tokens
+	a.anonymousRead = anonymousRead
+}
+
+func (a *Authenticator) lookup(secret string) *Token {
+	for i := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(a.tokens[i].Token), []byte(secret)) == 1 {
+			return &a.tokens[i]
+		}
+	}
+	return nil
+}
+
+// Identify returns the identity of the valid bearer token of r, or "" when
+// it has none.
+func (a *Authenticator) Identify(r *http.Request) string {
+	secret, ok := bearer(r)
+	if !ok {
+		return ""
+	}
+
+	a.lk.RLock()
+	defer a.lk.RUnlock()
+
+	if token := a.lookup(secret); token != nil {
+		return token.Identity
+	}
+	return ""
+}
+
+// RequireTokens answers 403 while no tokens are configured, for endpoints
+// that must not be open to everyone when auth is disabled.
+func (a *Authenticator) RequireTokens(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.lk.RLock()
+		enabled := len(a.tokens) > 0
+		a.lk.RUnlock()
+
+		if !enabled {
+			http.Error(w, "admin endpoints need auth tokens or an admin listener", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wrap requires the read scope for GET and HEAD requests and the write
+// scope for everything else.
+func (a *Authenticator) Wrap(next http.Handler) http.Handler {
+	return a.Require("")(next)
+}
+
+// Require checks the token for scope, an empty scope is derived from the
+// request method.
+func (a *Authenticator) Require(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			need := scope
+			if need == "" {
+				need = ScopeWrite
+				if r.Method == http.MethodGet || r.Method == http.MethodHead {
+					need = ScopeRead
+				}
+			}
+
+			a.lk.RLock()
+			enabled := len(a.tokens) > 0
+			anonymousRead := a.anonymousRead
+			var token *Token
+			if secret, ok := bearer(r); ok {
+				token = a.lookup(secret)
+			}
+			a.lk.RUnlock()
+
+			if !enabled {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if token == nil {
+				if need == ScopeRead && anonymousRead {
+					next.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if !token.has(need, namespace(r.URL.Path)) {
+				log.Debugw("missing scope", "identity", token.Identity, "scope", need, "path", r.URL.Path)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), token.Identity)))
+		})
+	}
+}
+
+func bearer(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimPrefix(h, "Bearer "), true
+}
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testTokens = []Token{
+	{Token: "r", Identity: "reader", Scopes: []string{ScopeRead}},
+	{Token: "w", Identity: "writer", Scopes: []string{ScopeRead, ScopeWrite}},
+	{Token: "a", Identity: "ops", Scopes: []string{ScopeAdmin}},
+	{Token: "n", Identity: "team1", Scopes: []string{"read:ns1", "write:ns1"}},
+}
+
+func TestRequire(t *testing.T) {
+	tests := []struct {
+		name          string
+		tokens        []Token
+		anonymousRead bool
+		scope         string
+		method        string
+		path          string
+		token         string
+		want          int
+		identity      string
+	}{
+		{name: "no tokens let everything through", method: http.MethodPost, path: "/block", want: http.StatusOK},
+		{name: "missing token", tokens: testTokens, method: http.MethodGet, path: "/block/x", want: http.StatusUnauthorized},
+		{name: "unknown token", tokens: testTokens, method: http.MethodGet, path: "/block/x", token: "x", want: http.StatusUnauthorized},
+		{name: "anonymous read", tokens: testTokens, anonymousRead: true, method: http.MethodGet, path: "/block/x", want: http.StatusOK},
+		{name: "anonymous head", tokens: testTokens, anonymousRead: true, method: http.MethodHead, path: "/block/x", want: http.StatusOK},
+		{name: "anonymous write", tokens: testTokens, anonymousRead: true, method: http.MethodPost, path: "/block", want: http.StatusUnauthorized},
+		{name: "read token reads", tokens: testTokens, method: http.MethodGet, path: "/block/x", token: "r", want: http.StatusOK, identity: "reader"},
+		{name: "read token cannot write", tokens: testTokens, method: http.MethodPost, path: "/block", token: "r", want: http.StatusForbidden},
+		{name: "write token writes", tokens: testTokens, method: http.MethodPost, path: "/block", token: "w", want: http.StatusOK, identity: "writer"},
+		{name: "write token writes in any namespace", tokens: testTokens, method: http.MethodPut, path: "/ns/ns2/block/x", token: "w", want: http.StatusOK, identity: "writer"},
+		{name: "write token is not admin", tokens: testTokens, scope: ScopeAdmin, method: http.MethodGet, path: "/admin/usage/x", token: "w", want: http.StatusForbidden},
+		{name: "admin token has every scope", tokens: testTokens, method: http.MethodPost, path: "/ns/ns2/block", token: "a", want: http.StatusOK, identity: "ops"},
+		{name: "admin scope", tokens: testTokens, scope: ScopeAdmin, method: http.MethodPost, path: "/admin/delete", token: "a", want: http.StatusOK, identity: "ops"},
+		{name: "namespace scope in its namespace", tokens: testTokens, method: http.MethodPost, path: "/ns/ns1/block", token: "n", want: http.StatusOK, identity: "team1"},
+		{name: "namespace scope reads its namespace", tokens: testTokens, method: http.MethodGet, path: "/ns/ns1/block/x", token: "n", want: http.StatusOK, identity: "team1"},
+		{name: "namespace scope in the default namespace", tokens: testTokens, method: http.MethodPost, path: "/block", token: "n", want: http.StatusForbidden},
+		{name: "namespace scope in another namespace", tokens: testTokens, method: http.MethodPost, path: "/ns/ns2/block", token: "n", want: http.StatusForbidden},
+		{name: "namespace scope is not a prefix", tokens: testTokens, method: http.MethodGet, path: "/ns/ns10/block/x", token: "n", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(tt.tokens, tt.anonymousRead)
+
+			var identity string
+			h := a.Require(tt.scope)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				identity = IdentityFromContext(r.Context())
+			}))
+
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d", w.Code, tt.want)
+			}
+			if identity != tt.identity {
+				t.Fatalf("identity %q, want %q", identity, tt.identity)
+			}
+			if tt.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Fatal("401 without a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "valid token", header: "Bearer w", want: "writer"},
+		{name: "unknown token", header: "Bearer x"},
+		{name: "no header"},
+		{name: "not a bearer token", header: "Basic dzp3"},
+	}
+
+	a := New(testTokens, false)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/block/x", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if got := a.Identify(r); got != tt.want {
+				t.Fatalf("identity %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetTokens(t *testing.T) {
+	a := New(testTokens, false)
+	a.SetTokens([]Token{{Token: "w2", Identity: "writer", Scopes: []string{ScopeWrite}}}, false)
+
+	h := a.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for token, want := range map[string]int{"w": http.StatusUnauthorized, "w2": http.StatusOK} {
+		r := httptest.NewRequest(http.MethodPost, "/block", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != want {
+			t.Fatalf("token %s: status %d, want %d", token, w.Code, want)
+		}
+	}
+}
+
+func TestRequireTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		tokens []Token
+		want   int
+	}{
+		{name: "auth disabled", want: http.StatusForbidden},
+		{name: "auth enabled", tokens: testTokens, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(tt.tokens, false)
+			h := a.RequireTokens(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/backup", nil))
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity string
+		want     string
+	}{
+		{name: "anonymous request", want: AdminListener},
+		{name: "authenticated request", identity: "alice", want: "alice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := WithIdentity(AdminListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = IdentityFromContext(r.Context())
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "/admin/delete", nil)
+			if tt.identity != "" {
+				r = r.WithContext(NewContext(r.Context(), tt.identity))
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Fatalf("identity %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
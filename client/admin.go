@@ -0,0 +1,131 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// LogLevel and LogFormat mirror the bodies of the admin log endpoints.
+type LogLevel struct {
+	Subsystem string `json:"subsystem"`
+	Level     string `json:"level"`
+}
+
+type LogFormat struct {
+	Format string `json:"format"`
+}
+
+type Version struct {
+	Version string `json:"version"`
+}
+
+// GetLogLevels asks the admin endpoints at addr for their log levels.
+func GetLogLevels(ctx context.Context, hc *http.Client, addr string) ([]LogLevel, error) {
+	url := fmt.Sprintf("%s/admin/log/levels", baseURL(addr))
+	resp, err := do(ctx, hc, "GetLogLevels", http.MethodGet, url, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		r, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("status: %s msg: %s", resp.Status, string(r))
+	}
+
+	var levels []LogLevel
+	err = json.NewDecoder(resp.Body).Decode(&levels)
+	if err != nil {
+		return nil, err
+	}
+	return levels, nil
+}
+
+// PostLogLevel sets the level of subsystem on the admin endpoints at addr,
+// "*" sets all subsystems.
+func PostLogLevel(ctx context.Context, hc *http.Client, addr string, subsystem string, level string) error {
+	url := fmt.Sprintf("%s/admin/log/level", baseURL(addr))
+	return postAdmin(ctx, hc, "PostLogLevel", url, LogLevel{Subsystem: subsystem, Level: level})
+}
+
+// PostLogFormat switches the log format of the admin endpoints at addr.
+func PostLogFormat(ctx context.Context, hc *http.Client, addr string, format string) error {
+	url := fmt.Sprintf("%s/admin/log/format", baseURL(addr))
+	return postAdmin(ctx, hc, "PostLogFormat", url, LogFormat{Format: format})
+}
+
+func postAdmin(ctx context.Context, hc *http.Client, name string, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	resp, err := do(ctx, hc, name, http.MethodPost, url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		r, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("status: %s msg: %s", resp.Status, string(r))
+	}
+
+	return nil
+}
+
+// GetVersion asks the admin endpoints at addr for their build version.
+func GetVersion(ctx context.Context, hc *http.Client, addr string) (string, error) {
+	url := fmt.Sprintf("%s/admin/version", baseURL(addr))
+	resp, err := do(ctx, hc, "GetVersion", http.MethodGet, url, "", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		r, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("status: %s msg: %s", resp.Status, string(r))
+	}
+
+	var v Version
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	if err != nil {
+		return "", err
+	}
+	return v.Version, nil
+}
+
+// GetProfile fetches the pprof profile served at path by the admin
+// endpoints at addr, e.g. /debug/pprof/heap.
+func GetProfile(ctx context.Context, hc *http.Client, addr string, path string) ([]byte, error) {
+	resp, err := do(ctx, hc, "GetProfile", http.MethodGet, baseURL(addr)+path, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status: %s msg: %s", resp.Status, string(body))
+	}
+
+	return body, nil
+}
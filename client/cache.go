@@ -0,0 +1,135 @@
+package client
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache is an lru of root blocks bounded by the total bytes it holds, a nil
+// Cache or one with size 0 caches nothing. Blocks are served for ttl after
+// they were added, so roots deleted or expired on the retrieve server stop
+// being served by then; a ttl of 0 keeps them until they are evicted.
+type Cache struct {
+	lk    sync.Mutex
+	size  int64
+	ttl   time.Duration
+	used  int64
+	order *list.List
+	items map[string]*list.Element
+
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+func NewCache(size int64, ttl time.Duration) *Cache {
+	return &Cache{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+		now:   time.Now,
+	}
+}
+
+func (c *Cache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && !c.now().Before(entry.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return entry.data, true
+}
+
+func (c *Cache) Add(key string, data []byte) {
+	if c == nil {
+		return
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if int64(len(data)) > c.size {
+		return
+	}
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+
+	entry := &cacheEntry{key: key, data: data}
+	if c.ttl > 0 {
+		entry.expires = c.now().Add(c.ttl)
+	}
+	c.items[key] = c.order.PushFront(entry)
+	c.used += int64(len(data))
+	c.evict()
+}
+
+// Resize changes the byte bound, evicting the least recently used blocks
+// when it shrinks.
+func (c *Cache) Resize(size int64) {
+	if c == nil {
+		return
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.size = size
+	c.evict()
+}
+
+// SetTTL changes how long blocks added from now on are served.
+func (c *Cache) SetTTL(ttl time.Duration) {
+	if c == nil {
+		return
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.ttl = ttl
+}
+
+// Purge drops every cached block.
+func (c *Cache) Purge() {
+	if c == nil {
+		return
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.order.Init()
+	c.items = make(map[string]*list.Element)
+	c.used = 0
+}
+
+func (c *Cache) evict() {
+	for c.used > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *Cache) remove(e *list.Element) {
+	entry := c.order.Remove(e).(*cacheEntry)
+	delete(c.items, entry.key)
+	c.used -= int64(len(entry.data))
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	tests := []struct {
+		name string
+		size int64
+		ttl  time.Duration
+		// how long after the block was added it is read
+		after time.Duration
+		hit   bool
+	}{
+		{name: "hit within the ttl", size: 10, ttl: time.Minute, after: 30 * time.Second, hit: true},
+		{name: "miss after the ttl", size: 10, ttl: time.Minute, after: time.Minute},
+		{name: "no ttl keeps the block", size: 10, after: time.Hour, hit: true},
+		{name: "block over the size is not cached", size: 2, ttl: time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			c := NewCache(tt.size, tt.ttl)
+			c.now = func() time.Time { return now }
+
+			c.Add("a", []byte("abc"))
+			now = now.Add(tt.after)
+
+			_, hit := c.Get("a")
+			if hit != tt.hit {
+				t.Fatalf("hit %t, want %t", hit, tt.hit)
+			}
+			if !hit && c.used != 0 {
+				t.Fatalf("%d bytes used after a miss", c.used)
+			}
+		})
+	}
+}
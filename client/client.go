@@ -2,8 +2,13 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"net/http"
+	"sync"
+	"time"
 
+	"github.com/gh-efforts/retrieve-server/requestid"
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
@@ -14,37 +19,173 @@ var log = logging.Logger("client")
 var ErrNotFound = errors.New("block not found")
 
 type Client struct {
-	addr string
+	lk         sync.RWMutex
+	addr       string
+	hc         *http.Client
+	namespaces []string
+	cache      *Cache
 }
 
-func New(addr string) *Client {
+// New returns a client for the retrieve server at addr, addr is either
+// host:port or a url with an http or https scheme.
+func New(addr string, hc *http.Client) *Client {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
 	return &Client{
 		addr: addr,
+		hc:   hc,
+	}
+}
+
+// NewHTTPClient returns an http client that dials with conf and sends token
+// as a bearer token, a nil conf keeps the default transport settings and a
+// zero timeout disables the request timeout.
+func NewHTTPClient(conf *tls.Config, token string, timeout time.Duration) *http.Client {
+	if conf == nil && token == "" && timeout == 0 {
+		return http.DefaultClient
+	}
+
+	var rt http.RoundTripper = http.DefaultTransport
+	if conf != nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = conf
+		rt = t
+	}
+	if token != "" {
+		rt = &bearerTransport{token: token, next: rt}
+	}
+
+	return &http.Client{Transport: rt, Timeout: timeout}
+}
+
+type bearerTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(req)
+}
+
+// SetBackend switches to another retrieve server or http client, requests
+// already sent finish on the old one.
+func (c *Client) SetBackend(addr string, hc *http.Client) {
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.addr = addr
+	c.hc = hc
+}
+
+// SetNamespaces serves blocks from the namespaces in order, none serves the
+// default namespace. Cached blocks are dropped since they may come from a
+// namespace no longer served.
+func (c *Client) SetNamespaces(namespaces []string) {
+	c.lk.Lock()
+	c.namespaces = namespaces
+	c.lk.Unlock()
+
+	c.cache.Purge()
+}
+
+func (c *Client) backend() (*http.Client, string) {
+	c.lk.RLock()
+	defer c.lk.RUnlock()
+	return c.hc, c.addr
+}
+
+// lookups returns the addresses blocks are looked up at, one for each
+// namespace served.
+func (c *Client) lookups() (*http.Client, []string) {
+	c.lk.RLock()
+	defer c.lk.RUnlock()
+
+	if len(c.namespaces) == 0 {
+		return c.hc, []string{c.addr}
 	}
+
+	addrs := make([]string, len(c.namespaces))
+	for i, ns := range c.namespaces {
+		addrs[i] = NamespaceAddr(c.addr, ns)
+	}
+	return c.hc, addrs
+}
+
+// WithCache serves blocks from cache before asking the retrieve server.
+func (c *Client) WithCache(cache *Cache) *Client {
+	c.cache = cache
+	return c
+}
+
+// Ping checks that the retrieve server is reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	hc, addr := c.backend()
+	return GetHealthz(ctx, hc, addr)
 }
 
+// BlockstoreGet looks root up in each namespace served until one holds it,
+// errors other than a miss are returned right away.
 func (c *Client) BlockstoreGet(ctx context.Context, cid cid.Cid) ([]byte, error) {
-	rb, err := GetBlock(c.addr, cid.String())
-	if err != nil {
-		log.Error(err)
-		return nil, ErrNotFound
+	if data, ok := c.cache.Get(cid.String()); ok {
+		return data, nil
+	}
+
+	hc, addrs := c.lookups()
+	for _, addr := range addrs {
+		rb, err := GetBlock(ctx, hc, addr, cid.String())
+		if errors.Is(err, ErrNotFound) {
+			log.Debugw("BlockstoreGet miss", "requestID", requestid.FromContext(ctx), "addr", addr, "root", cid)
+			continue
+		}
+		if err != nil {
+			log.Errorw("BlockstoreGet", "requestID", requestid.FromContext(ctx), "addr", addr, "root", cid, "err", err)
+			return nil, err
+		}
+
+		c.cache.Add(cid.String(), rb.Block)
+		return rb.Block, nil
 	}
 
-	return rb.Block, nil
+	return nil, ErrNotFound
 }
 
 func (c *Client) BlockstoreGetSize(ctx context.Context, cid cid.Cid) (int, error) {
-	rz, err := GetSize(c.addr, cid.String())
-	if err != nil {
-		log.Error(err)
-		return 0, ErrNotFound
+	if data, ok := c.cache.Get(cid.String()); ok {
+		return len(data), nil
 	}
 
-	return rz.Size, nil
+	hc, addrs := c.lookups()
+	for _, addr := range addrs {
+		rz, err := GetSize(ctx, hc, addr, cid.String())
+		if errors.Is(err, ErrNotFound) {
+			log.Debugw("BlockstoreGetSize miss", "requestID", requestid.FromContext(ctx), "addr", addr, "root", cid)
+			continue
+		}
+		if err != nil {
+			log.Errorw("BlockstoreGetSize", "requestID", requestid.FromContext(ctx), "addr", addr, "root", cid, "err", err)
+			return 0, err
+		}
+
+		return rz.Size, nil
+	}
+
+	return 0, ErrNotFound
 }
 
 func (c *Client) BlockstoreHas(ctx context.Context, cid cid.Cid) (bool, error) {
-	return GetHas(c.addr, cid.String()), nil
+	_, err := c.BlockstoreGetSize(ctx, cid)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 func (c *Client) Get(ctx context.Context, cid cid.Cid) (b blocks.Block, err error) {
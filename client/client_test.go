@@ -0,0 +1,83 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestBlockstoreGet(t *testing.T) {
+	mh, err := multihash.Sum([]byte("block"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := cid.NewCidV1(cid.Raw, mh)
+
+	tests := []struct {
+		name string
+		// status answered by each namespace
+		status  map[string]int
+		want    string
+		wantErr error
+	}{
+		{name: "first namespace holds it", status: map[string]int{"a": 200, "b": 500}, want: "a"},
+		{name: "later namespace holds it", status: map[string]int{"a": 404, "b": 200}, want: "b"},
+		{name: "no namespace holds it", status: map[string]int{"a": 404, "b": 404}, wantErr: ErrNotFound},
+		{name: "backend error is not a miss", status: map[string]int{"a": 500, "b": 200}},
+		{name: "backend error after a miss", status: map[string]int{"a": 404, "b": 503}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ns := strings.Split(r.URL.Path, "/")[2]
+				if status := tt.status[ns]; status != http.StatusOK {
+					http.Error(w, "failed", status)
+					return
+				}
+				if strings.Contains(r.URL.Path, "/size/") {
+					json.NewEncoder(w).Encode(RootSize{Root: root.String(), Size: len(ns)})
+					return
+				}
+				json.NewEncoder(w).Encode(RootBlock{Root: root.String(), Block: []byte(ns)})
+			}))
+			defer srv.Close()
+
+			c := New(srv.URL, srv.Client())
+			c.SetNamespaces([]string{"a", "b"})
+
+			block, err := c.BlockstoreGet(context.Background(), root)
+			size, sizeErr := c.BlockstoreGetSize(context.Background(), root)
+			has, hasErr := c.BlockstoreHas(context.Background(), root)
+
+			if tt.want == "" {
+				if err == nil || sizeErr == nil {
+					t.Fatalf("no error: %q %d", block, size)
+				}
+				if errors.Is(err, ErrNotFound) != (tt.wantErr != nil) || errors.Is(sizeErr, ErrNotFound) != (tt.wantErr != nil) {
+					t.Fatalf("errors %v and %v, want not found %t", err, sizeErr, tt.wantErr != nil)
+				}
+				if has || (hasErr == nil) != (tt.wantErr != nil) {
+					t.Fatalf("has %t %v", has, hasErr)
+				}
+				return
+			}
+			if err != nil || string(block) != tt.want {
+				t.Fatalf("block %q %v, want %q", block, err, tt.want)
+			}
+			if sizeErr != nil || size != len(tt.want) {
+				t.Fatalf("size %d %v, want %d", size, sizeErr, len(tt.want))
+			}
+			if !has || hasErr != nil {
+				t.Fatalf("has %t %v", has, hasErr)
+			}
+		})
+	}
+}
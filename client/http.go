@@ -2,12 +2,26 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gh-efforts/retrieve-server/requestid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/gh-efforts/retrieve-server/client")
+
 type RootBlock struct {
 	Root  string `json:"root"`
 	Block []byte `json:"block"`
@@ -18,20 +32,81 @@ type RootSize struct {
 	Size int    `json:"size"`
 }
 
-func GetBlock(addr string, root string) (*RootBlock, error) {
-	url := fmt.Sprintf("http://%s/block/%s", addr, root)
-	resp, err := http.Get(url)
+// baseURL turns a server address into a url prefix, addresses without a
+// scheme are served over plain http.
+func baseURL(addr string) string {
+	if strings.Contains(addr, "://") {
+		return strings.TrimSuffix(addr, "/")
+	}
+	return "http://" + addr
+}
+
+// NamespaceAddr returns the address of namespace ns on the retrieve server
+// at addr, the block functions given it act on that namespace.
+func NamespaceAddr(addr string, ns string) string {
+	return baseURL(addr) + "/ns/" + url.PathEscape(ns)
+}
+
+// do sends the request inside a client span and injects the trace context
+// into its headers.
+func do(ctx context.Context, hc *http.Client, name string, method string, url string, contentType string, body io.Reader) (*http.Response, error) {
+	ctx, span := tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.method", method), attribute.String("url.full", url)),
+	)
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}
+
+// statusError returns the error answered by the server, it wraps
+// ErrNotFound for a 404.
+func statusError(resp *http.Response) error {
+	r, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	err = fmt.Errorf("status: %s msg: %s", resp.Status, string(r))
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	return err
+}
+
+func GetBlock(ctx context.Context, hc *http.Client, addr string, root string) (*RootBlock, error) {
+	url := fmt.Sprintf("%s/block/%s", baseURL(addr), root)
+	resp, err := do(ctx, hc, "GetBlock", http.MethodGet, url, "", nil)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		r, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-		return nil, fmt.Errorf("status: %s msg: %s", resp.Status, string(r))
+		return nil, statusError(resp)
 	}
 
 	var rb RootBlock
@@ -40,24 +115,20 @@ func GetBlock(addr string, root string) (*RootBlock, error) {
 		return nil, err
 	}
 
-	log.Debugw("GetBlock", "root", root, "size", len(rb.Block))
+	log.Debugw("GetBlock", "requestID", requestid.FromContext(ctx), "root", root, "size", len(rb.Block))
 	return &rb, nil
 }
 
-func GetSize(addr string, root string) (*RootSize, error) {
-	url := fmt.Sprintf("http://%s/size/%s", addr, root)
-	resp, err := http.Get(url)
+func GetSize(ctx context.Context, hc *http.Client, addr string, root string) (*RootSize, error) {
+	url := fmt.Sprintf("%s/size/%s", baseURL(addr), root)
+	resp, err := do(ctx, hc, "GetSize", http.MethodGet, url, "", nil)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		r, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-		return nil, fmt.Errorf("status: %s msg: %s", resp.Status, string(r))
+		return nil, statusError(resp)
 	}
 
 	var rz RootSize
@@ -66,27 +137,55 @@ func GetSize(addr string, root string) (*RootSize, error) {
 		return nil, err
 	}
 
-	log.Debugw("GetSize", "root", root, "size", rz.Size)
+	log.Debugw("GetSize", "requestID", requestid.FromContext(ctx), "root", root, "size", rz.Size)
 	return &rz, nil
 }
 
-func GetHas(addr string, root string) bool {
-	rz, err := GetSize(addr, root)
+func GetHas(ctx context.Context, hc *http.Client, addr string, root string) bool {
+	rz, err := GetSize(ctx, hc, addr, root)
+	if errors.Is(err, ErrNotFound) {
+		log.Debugw("GetHas", "requestID", requestid.FromContext(ctx), "root", root, "has", false)
+		return false
+	}
 	if err != nil {
-		log.Error(err)
+		log.Errorw("GetHas", "requestID", requestid.FromContext(ctx), "root", root, "err", err)
 		return false
 	}
 
 	if root == rz.Root {
-		log.Debugw("GetHas", "root", root, "has", true)
+		log.Debugw("GetHas", "requestID", requestid.FromContext(ctx), "root", root, "has", true)
 		return true
 	}
 
-	log.Debugw("GetHas", "root", root, "has", false)
+	log.Debugw("GetHas", "requestID", requestid.FromContext(ctx), "root", root, "has", false)
 	return false
 }
 
-func PostRootBlock(addr string, root string, block []byte) error {
+// GetHealthz checks that the retrieve server at addr answers its liveness probe.
+func GetHealthz(ctx context.Context, hc *http.Client, addr string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL(addr)+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		r, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("status: %s msg: %s", resp.Status, string(r))
+	}
+
+	return nil
+}
+
+func PostRootBlock(ctx context.Context, hc *http.Client, addr string, root string, block []byte) error {
 	rb := RootBlock{
 		Root:  root,
 		Block: block,
@@ -97,8 +196,115 @@ func PostRootBlock(addr string, root string, block []byte) error {
 		return err
 	}
 
-	url := fmt.Sprintf("http://%s/block", addr)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	url := fmt.Sprintf("%s/block", baseURL(addr))
+	resp, err := do(ctx, hc, "PostRootBlock", http.MethodPost, url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		r, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("status: %s msg: %s", resp.Status, string(r))
+	}
+
+	log.Debugw("PostRootBlock", "requestID", requestid.FromContext(ctx), "root", root, "size", len(block))
+	return nil
+}
+
+// PostCar streams a car file to the retrieve server, which stores the blocks
+// of roots, or of the car header roots when none are given.
+func PostCar(ctx context.Context, hc *http.Client, addr string, car io.Reader, roots []string) ([]string, error) {
+	q := url.Values{}
+	for _, root := range roots {
+		q.Add("root", root)
+	}
+
+	u := fmt.Sprintf("%s/car?%s", baseURL(addr), q.Encode())
+	resp, err := do(ctx, hc, "PostCar", http.MethodPost, u, "application/vnd.ipld.car", car)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		r, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("status: %s msg: %s", resp.Status, string(r))
+	}
+
+	var stored []string
+	err = json.NewDecoder(resp.Body).Decode(&stored)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugw("PostCar", "requestID", requestid.FromContext(ctx), "roots", stored)
+	return stored, nil
+}
+
+// DeleteFilter selects the roots of a bulk delete, see the server for the
+// meaning of each condition.
+type DeleteFilter struct {
+	Roots         []string   `json:"roots,omitempty"`
+	Provider      string     `json:"provider,omitempty"`
+	PieceCid      string     `json:"piece_cid,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	MinSize       *int64     `json:"min_size,omitempty"`
+	MaxSize       *int64     `json:"max_size,omitempty"`
+	DryRun        bool       `json:"dry_run,omitempty"`
+	BatchSize     int        `json:"batch_size,omitempty"`
+}
+
+type DeleteResult struct {
+	Roots  int64 `json:"roots"`
+	Bytes  int64 `json:"bytes"`
+	DryRun bool  `json:"dry_run"`
+}
+
+// BulkDelete deletes the roots matching f on the admin endpoint of the
+// retrieve server.
+func BulkDelete(ctx context.Context, hc *http.Client, addr string, f *DeleteFilter) (*DeleteResult, error) {
+	body, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/admin/delete", baseURL(addr))
+	resp, err := do(ctx, hc, "BulkDelete", http.MethodPost, url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		r, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("status: %s msg: %s", resp.Status, string(r))
+	}
+
+	var res DeleteResult
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugw("BulkDelete", "requestID", requestid.FromContext(ctx), "roots", res.Roots, "bytes", res.Bytes, "dryRun", res.DryRun)
+	return &res, nil
+}
+
+// Backup has the server copy its db to the new directory dir on the
+// server host while it keeps serving.
+func Backup(ctx context.Context, hc *http.Client, addr string, dir string) error {
+	url := fmt.Sprintf("%s/admin/backup?dir=%s", baseURL(addr), url.QueryEscape(dir))
+	resp, err := do(ctx, hc, "Backup", http.MethodPost, url, "", nil)
 	if err != nil {
 		return err
 	}
@@ -112,6 +318,6 @@ func PostRootBlock(addr string, root string, block []byte) error {
 		return fmt.Errorf("status: %s msg: %s", resp.Status, string(r))
 	}
 
-	log.Debugw("PostRootBlock", "root", root, "size", len(block))
+	log.Debugw("Backup", "requestID", requestid.FromContext(ctx), "dir", dir)
 	return nil
 }
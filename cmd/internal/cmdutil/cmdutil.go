@@ -0,0 +1,51 @@
+// Package cmdutil holds the plumbing the retrieve-server and retrieve-http
+// run commands share: tls setup, log setup, admin mounting, config reload
+// and shutdown.
+package cmdutil
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gh-efforts/retrieve-server/admin"
+	"github.com/gh-efforts/retrieve-server/auth"
+	"github.com/gh-efforts/retrieve-server/config"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("main")
+
+// MountAdmin serves the admin endpoints on the public listener behind the
+// admin scope. Metrics and profiles are open while no tokens are
+// configured, the /admin/ endpoints are refused until there are some.
+func MountAdmin(mux *http.ServeMux, h http.Handler, authn *auth.Authenticator) {
+	h = authn.Require(auth.ScopeAdmin)(h)
+	mux.Handle("/metrics", h)
+	mux.Handle("/debug/", h)
+	mux.Handle("/admin/", authn.RequireTokens(h))
+}
+
+// SetLog applies the log format and sets the level of the given subsystems,
+// the per-subsystem levels of c override it.
+func SetLog(c config.Log, subsystems []string) error {
+	if c.Format != "" {
+		if err := admin.SetLogFormat(c.Format); err != nil {
+			return err
+		}
+	}
+
+	if _, err := logging.LevelFromString(c.Level); err != nil {
+		return fmt.Errorf("log level: %w", err)
+	}
+	for _, sub := range subsystems {
+		logging.SetLogLevel(sub, c.Level)
+	}
+
+	for sub, level := range c.Subsystems {
+		if err := logging.SetLogLevel(sub, level); err != nil {
+			return fmt.Errorf("log level %s: %w", sub, err)
+		}
+	}
+
+	return nil
+}
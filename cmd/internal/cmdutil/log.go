@@ -0,0 +1,87 @@
+package cmdutil
+
+import (
+	"fmt"
+
+	"github.com/gh-efforts/retrieve-server/client"
+	"github.com/urfave/cli/v2"
+)
+
+// LogCmd manages the logging of the running binary name whose admin
+// endpoints listen on connect by default, envPrefix names the token
+// variable of ClientFlags.
+func LogCmd(name string, connect string, envPrefix string) *cli.Command {
+	return &cli.Command{
+		Name:  "log",
+		Usage: "Manage logging of a running " + name,
+		Subcommands: []*cli.Command{
+			logList,
+			logSetLevel,
+			logSetFormat,
+		},
+		Flags: append([]cli.Flag{
+			&cli.StringFlag{
+				Name:  "connect",
+				Value: connect,
+				Usage: "address serving the admin endpoints of the " + name + ", a url such as https://host:port for tls",
+			},
+		}, ClientFlags(envPrefix)...),
+	}
+}
+
+var logList = &cli.Command{
+	Name:  "list",
+	Usage: "List log subsystems and their levels",
+	Action: func(cctx *cli.Context) error {
+		hc, err := NewHTTPClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		levels, err := client.GetLogLevels(cctx.Context, hc, cctx.String("connect"))
+		if err != nil {
+			return err
+		}
+
+		for _, ll := range levels {
+			fmt.Printf("%-12s %s\n", ll.Subsystem, ll.Level)
+		}
+		return nil
+	},
+}
+
+var logSetLevel = &cli.Command{
+	Name:      "set-level",
+	Usage:     "Set the level of a log subsystem, * for all",
+	ArgsUsage: "<subsystem> <level>",
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() < 2 {
+			return fmt.Errorf("args < 2")
+		}
+
+		hc, err := NewHTTPClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		return client.PostLogLevel(cctx.Context, hc, cctx.String("connect"), cctx.Args().Get(0), cctx.Args().Get(1))
+	},
+}
+
+var logSetFormat = &cli.Command{
+	Name:      "set-format",
+	Usage:     "Switch the log format: color, nocolor or json",
+	ArgsUsage: "<format>",
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() < 1 {
+			return fmt.Errorf("args < 1")
+		}
+
+		hc, err := NewHTTPClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		return client.PostLogFormat(cctx.Context, hc, cctx.String("connect"), cctx.Args().Get(0))
+	},
+}
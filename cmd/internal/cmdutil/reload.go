@@ -0,0 +1,40 @@
+package cmdutil
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gh-efforts/retrieve-server/config"
+)
+
+// ReloadOnSIGHUP calls reload every time the process receives SIGHUP.
+func ReloadOnSIGHUP(ctx context.Context, reload func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				log.Info("received SIGHUP, reloading config")
+				reload()
+			}
+		}
+	}()
+}
+
+// LogChanges logs the settings changed between old and applied, and the
+// ones in next that only take effect after a restart.
+func LogChanges(old, applied, next any) {
+	for _, c := range config.Diff(old, applied) {
+		log.Infow("config applied", "key", c.Key, "old", c.Old, "new", c.New)
+	}
+	for _, c := range config.Diff(applied, next) {
+		log.Warnw("config change needs a restart", "key", c.Key, "old", c.Old, "new", c.New)
+	}
+}
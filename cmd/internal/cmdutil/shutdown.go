@@ -0,0 +1,32 @@
+package cmdutil
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gh-efforts/retrieve-server/middleware"
+)
+
+// Shutdown keeps serving for delay once readiness fails, so load balancers
+// see the failing probe before the listener closes. It then stops accepting
+// connections and waits up to grace for the requests being served, the ones
+// still running after that are aborted.
+func Shutdown(server *http.Server, delay, grace time.Duration, tracker *middleware.Tracker) {
+	if delay > 0 {
+		log.Infow("waiting before closing the listener", "delay", delay.String())
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err == nil {
+		log.Info("drained requests in flight")
+		return
+	}
+
+	aborted := tracker.Active()
+	server.Close()
+	log.Warnw("shutdown grace period over, aborted requests in flight", "aborted", aborted)
+}
@@ -0,0 +1,103 @@
+package cmdutil
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/gh-efforts/retrieve-server/client"
+	"github.com/gh-efforts/retrieve-server/config"
+	"github.com/gh-efforts/retrieve-server/tlsutil"
+	"github.com/urfave/cli/v2"
+)
+
+// ClientFlags configure how a command reaches a running server, the token
+// can also be set with the <envPrefix>_TOKEN variable.
+func ClientFlags(envPrefix string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "CA bundle used to verify the server certificate",
+		},
+		&cli.StringFlag{
+			Name:  "tls-client-cert",
+			Usage: "client certificate presented to the server (mTLS)",
+		},
+		&cli.StringFlag{
+			Name:  "tls-client-key",
+			Usage: "private key file for --tls-client-cert",
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "bearer token sent to the server",
+			EnvVars: []string{envPrefix + "_TOKEN"},
+		},
+	}
+}
+
+// NewHTTPClient returns the http client of a command using ClientFlags.
+func NewHTTPClient(cctx *cli.Context) (*http.Client, error) {
+	conf, _, err := ClientTLS(config.ClientTLS{
+		CA:   cctx.String("tls-ca"),
+		Cert: cctx.String("tls-client-cert"),
+		Key:  cctx.String("tls-client-key"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return client.NewHTTPClient(conf, cctx.String("token"), 0), nil
+}
+
+// ServerTLS returns nil when tls is not configured for the listener.
+func ServerTLS(c config.TLS) (*tls.Config, *tlsutil.Reloader, error) {
+	if c.Cert == "" && c.Key == "" {
+		if c.ClientCA != "" {
+			return nil, nil, fmt.Errorf("tls client_ca requires tls cert and key")
+		}
+		return nil, nil, nil
+	}
+	if c.Cert == "" || c.Key == "" {
+		return nil, nil, fmt.Errorf("both tls cert and key are required")
+	}
+
+	r, err := tlsutil.NewReloader(c.Cert, c.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conf, err := tlsutil.ServerConfig(r, c.ClientCA)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conf, r, nil
+}
+
+// ClientTLS returns nil when the server is reached over plain http with
+// the system roots.
+func ClientTLS(c config.ClientTLS) (*tls.Config, *tlsutil.Reloader, error) {
+	if c.CA == "" && c.Cert == "" && c.Key == "" {
+		return nil, nil, nil
+	}
+
+	var r *tlsutil.Reloader
+	if c.Cert != "" || c.Key != "" {
+		if c.Cert == "" || c.Key == "" {
+			return nil, nil, fmt.Errorf("both client tls cert and key are required")
+		}
+
+		var err error
+		r, err = tlsutil.NewReloader(c.Cert, c.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	conf, err := tlsutil.ClientConfig(c.CA, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conf, r, nil
+}
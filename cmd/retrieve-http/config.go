@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+
+	"github.com/gh-efforts/retrieve-server/config"
+	"github.com/urfave/cli/v2"
+)
+
+var configCmd = &cli.Command{
+	Name:  "config",
+	Usage: "manage the run config file",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "default",
+			Usage: "print the default config as an annotated toml template",
+			Action: func(cctx *cli.Context) error {
+				return config.WriteTemplate(os.Stdout, config.DefaultHTTP())
+			},
+		},
+	},
+}
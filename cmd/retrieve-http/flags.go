@@ -0,0 +1,198 @@
+package main
+
+import (
+	"github.com/gh-efforts/retrieve-server/auth"
+	"github.com/gh-efforts/retrieve-server/config"
+	"github.com/gh-efforts/retrieve-server/middleware"
+	"github.com/gh-efforts/retrieve-server/tracing"
+	"github.com/urfave/cli/v2"
+)
+
+// flag values only document the defaults, settings come from
+// config.DefaultServer, the config file, the environment and then the
+// flags set on the command line.
+var defaults = config.DefaultHTTP()
+
+var configFlag = &cli.StringFlag{
+	Name:    "config",
+	Usage:   "toml config file, see `config default`",
+	EnvVars: []string{"RHTTP_CONFIG"},
+}
+
+var limitFlags = []cli.Flag{
+	&cli.Float64Flag{
+		Name:  "rate-limit",
+		Value: defaults.Limits.Rate,
+		Usage: "requests per second allowed for each client ip or token, 0 disables",
+	},
+	&cli.IntFlag{
+		Name:  "rate-burst",
+		Value: defaults.Limits.Burst,
+		Usage: "burst size of the per-client rate limit",
+	},
+	&cli.IntFlag{
+		Name:  "max-in-flight",
+		Value: defaults.Limits.MaxInFlight,
+		Usage: "requests served at once, 0 disables the cap",
+	},
+	&cli.IntFlag{
+		Name:  "max-queue",
+		Value: defaults.Limits.MaxQueue,
+		Usage: "requests waiting for an in-flight slot before answering 429",
+	},
+	&cli.DurationFlag{
+		Name:  "queue-timeout",
+		Value: defaults.Limits.QueueTimeout,
+		Usage: "how long a queued request waits for an in-flight slot",
+	},
+}
+
+var accessLogFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "access-log",
+		Value: defaults.AccessLog.Output,
+		Usage: "access log output: stdout, stderr or a file path rotated by size",
+	},
+	&cli.Float64Flag{
+		Name:  "access-log-sample",
+		Value: defaults.AccessLog.SampleRate,
+		Usage: "fraction of successful requests written to the access log, failed requests are always written",
+	},
+	&cli.IntFlag{
+		Name:  "access-log-max-size",
+		Value: defaults.AccessLog.MaxSizeMB,
+		Usage: "megabytes an access log file grows to before it is rotated",
+	},
+	&cli.IntFlag{
+		Name:  "access-log-max-backups",
+		Value: defaults.AccessLog.MaxBackups,
+		Usage: "rotated access log files to keep, 0 keeps all",
+	},
+	&cli.IntFlag{
+		Name:  "access-log-max-age",
+		Value: defaults.AccessLog.MaxAgeDays,
+		Usage: "days to keep rotated access log files, 0 keeps them forever",
+	},
+}
+
+var tracingFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "tracing-exporter",
+		Value: defaults.Tracing.Exporter,
+		Usage: "export opentelemetry spans: otlp or stdout, empty disables tracing",
+	},
+	&cli.StringFlag{
+		Name:  "tracing-endpoint",
+		Value: defaults.Tracing.Endpoint,
+		Usage: "host:port of the otlp http collector",
+	},
+	&cli.BoolFlag{
+		Name:  "tracing-insecure",
+		Usage: "send spans to the otlp collector over plain http",
+	},
+	&cli.Float64Flag{
+		Name:  "tracing-sample-ratio",
+		Value: defaults.Tracing.SampleRatio,
+		Usage: "fraction of new traces sampled, traces started upstream follow the caller's decision",
+	},
+}
+
+func flags(groups ...[]cli.Flag) []cli.Flag {
+	var all []cli.Flag
+	for _, g := range groups {
+		all = append(all, g...)
+	}
+	return all
+}
+
+// loadConfig builds the run config, later sources override earlier ones:
+// defaults, --config file, RHTTP_* environment, command line flags.
+func loadConfig(cctx *cli.Context) (*config.HTTP, error) {
+	cfg := config.DefaultHTTP()
+	if err := config.Load(cctx.String("config"), "RHTTP", cfg); err != nil {
+		return nil, err
+	}
+
+	if cctx.IsSet("debug") && cctx.Bool("debug") {
+		cfg.Log.Level = "debug"
+	}
+
+	err := config.ApplyFlags(cctx, map[string]any{
+		"listen":                 &cfg.Listen,
+		"admin-listen":           &cfg.AdminListen,
+		"drain-delay":            &cfg.DrainDelay,
+		"shutdown-grace":         &cfg.ShutdownGrace,
+		"namespace":              &cfg.Namespaces,
+		"server-addr":            &cfg.Backend.Addr,
+		"server-token":           &cfg.Backend.Token,
+		"server-timeout":         &cfg.Backend.Timeout,
+		"server-tls-ca":          &cfg.Backend.TLS.CA,
+		"server-tls-cert":        &cfg.Backend.TLS.Cert,
+		"server-tls-key":         &cfg.Backend.TLS.Key,
+		"cache-size":             &cfg.Cache.Size,
+		"cache-ttl":              &cfg.Cache.TTL,
+		"tls-cert":               &cfg.TLS.Cert,
+		"tls-key":                &cfg.TLS.Key,
+		"tls-client-ca":          &cfg.TLS.ClientCA,
+		"rate-limit":             &cfg.Limits.Rate,
+		"rate-burst":             &cfg.Limits.Burst,
+		"max-in-flight":          &cfg.Limits.MaxInFlight,
+		"max-queue":              &cfg.Limits.MaxQueue,
+		"queue-timeout":          &cfg.Limits.QueueTimeout,
+		"access-log":             &cfg.AccessLog.Output,
+		"access-log-sample":      &cfg.AccessLog.SampleRate,
+		"access-log-max-size":    &cfg.AccessLog.MaxSizeMB,
+		"access-log-max-backups": &cfg.AccessLog.MaxBackups,
+		"access-log-max-age":     &cfg.AccessLog.MaxAgeDays,
+		"tracing-exporter":       &cfg.Tracing.Exporter,
+		"tracing-endpoint":       &cfg.Tracing.Endpoint,
+		"tracing-insecure":       &cfg.Tracing.Insecure,
+		"tracing-sample-ratio":   &cfg.Tracing.SampleRatio,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func limits(c config.Limits) middleware.Limits {
+	return middleware.Limits{
+		Rate:         c.Rate,
+		Burst:        c.Burst,
+		MaxInFlight:  c.MaxInFlight,
+		MaxQueue:     c.MaxQueue,
+		QueueTimeout: c.QueueTimeout,
+	}
+}
+
+func accessLogConfig(c config.AccessLog) middleware.AccessLogConfig {
+	return middleware.AccessLogConfig{
+		Output:     c.Output,
+		SampleRate: c.SampleRate,
+		MaxSizeMB:  c.MaxSizeMB,
+		MaxBackups: c.MaxBackups,
+		MaxAgeDays: c.MaxAgeDays,
+	}
+}
+
+func tracingConfig(c config.Tracing) tracing.Config {
+	return tracing.Config{
+		Exporter:    c.Exporter,
+		Endpoint:    c.Endpoint,
+		Insecure:    c.Insecure,
+		SampleRatio: c.SampleRatio,
+	}
+}
+
+func authTokens(c config.Auth) []auth.Token {
+	tokens := make([]auth.Token, len(c.Tokens))
+	for i, t := range c.Tokens {
+		tokens[i] = auth.Token{
+			Token:    t.Token,
+			Identity: t.Identity,
+			Scopes:   t.Scopes,
+		}
+	}
+	return tokens
+}
@@ -2,18 +2,25 @@ package main
 
 import (
 	"compress/gzip"
+	"context"
 	"net/http"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
 	"contrib.go.opencensus.io/exporter/prometheus"
+	"github.com/gh-efforts/retrieve-server/admin"
+	"github.com/gh-efforts/retrieve-server/auth"
 	"github.com/gh-efforts/retrieve-server/build"
 	"github.com/gh-efforts/retrieve-server/client"
+	"github.com/gh-efforts/retrieve-server/cmd/internal/cmdutil"
+	"github.com/gh-efforts/retrieve-server/health"
 	"github.com/gh-efforts/retrieve-server/metrics"
+	"github.com/gh-efforts/retrieve-server/middleware"
+	"github.com/gh-efforts/retrieve-server/tracing"
 	"github.com/ipld/frisbii"
 
 	"github.com/filecoin-project/boost-graphsync/storeutil"
-	cliutil "github.com/filecoin-project/lotus/cli/util"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/urfave/cli/v2"
 	"go.opencensus.io/stats"
@@ -26,6 +33,8 @@ var log = logging.Logger("main")
 func main() {
 	local := []*cli.Command{
 		runCmd,
+		cmdutil.LogCmd("retrieve-http", "127.0.0.1:9874", "RHTTP"),
+		configCmd,
 	}
 
 	app := &cli.App{
@@ -42,26 +51,77 @@ func main() {
 
 var runCmd = &cli.Command{
 	Name: "run",
-	Flags: []cli.Flag{
+	Flags: flags([]cli.Flag{
+		configFlag,
 		&cli.StringFlag{
 			Name:  "listen",
-			Value: "0.0.0.0:9875",
+			Value: defaults.Listen,
+		},
+		&cli.StringFlag{
+			Name:  "admin-listen",
+			Value: defaults.AdminListen,
+			Usage: "address for pprof, metrics and health probes, which are not served on --listen unless this is empty",
 		},
 		&cli.BoolFlag{
 			Name:  "debug",
 			Value: false,
 		},
+		&cli.DurationFlag{
+			Name:  "drain-delay",
+			Value: defaults.DrainDelay,
+			Usage: "how long shutdown keeps serving with readiness failing before closing the listener",
+		},
+		&cli.DurationFlag{
+			Name:  "shutdown-grace",
+			Value: defaults.ShutdownGrace,
+			Usage: "how long shutdown waits for requests in flight before aborting them",
+		},
 		&cli.StringFlag{
 			Name:  "server-addr",
-			Value: "127.0.0.1:9876",
+			Value: defaults.Backend.Addr,
+			Usage: "host:port, or a url such as https://host:port",
 		},
-	},
+		&cli.DurationFlag{
+			Name:  "server-timeout",
+			Value: defaults.Backend.Timeout,
+			Usage: "timeout of a single request to the retrieve server, 0 disables",
+		},
+		&cli.StringSliceFlag{
+			Name:  "namespace",
+			Usage: "retrieve server namespace to serve, repeat to look blocks up in several in order",
+		},
+		&cli.Int64Flag{
+			Name:  "cache-size",
+			Value: defaults.Cache.Size,
+			Usage: "bytes of blocks cached in memory, 0 disables the cache",
+		},
+		&cli.DurationFlag{
+			Name:  "cache-ttl",
+			Value: defaults.Cache.TTL,
+			Usage: "how long a cached block is served, 0 keeps blocks until they are evicted",
+		},
+	}, tlsFlags, limitFlags, accessLogFlags, tracingFlags),
 	Action: func(cctx *cli.Context) error {
-		setLog(cctx.Bool("debug"))
+		cfg, err := loadConfig(cctx)
+		if err != nil {
+			return err
+		}
+
+		if err := cmdutil.SetLog(cfg.Log, subsystems); err != nil {
+			return err
+		}
 
 		log.Info("starting retrieve http ...")
 
-		ctx := cliutil.ReqContext(cctx)
+		// SIGHUP reloads the config, so only SIGINT and SIGTERM stop the server
+		ctx, stop := signal.NotifyContext(cctx.Context, syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		shutdownTracing, err := tracing.Setup(ctx, "retrieve-http", tracingConfig(cfg.Tracing))
+		if err != nil {
+			return err
+		}
+		defer shutdownTracing(context.Background())
 
 		exporter, err := prometheus.NewExporter(prometheus.Options{
 			Namespace: "rhttp",
@@ -81,38 +141,120 @@ var runCmd = &cli.Command{
 		}
 		stats.Record(ctx, metrics.Info.M(1))
 
-		listen := cctx.String("listen")
-		log.Infow("retrieve http", "listen", listen)
+		log.Infow("retrieve http", "listen", cfg.Listen)
+
+		mux := http.NewServeMux()
+		api := http.NewServeMux()
+		adminMux := admin.NewMux(exporter)
+
+		authn := auth.New(authTokens(cfg.Auth), cfg.Auth.AnonymousRead)
+		mux.Handle("/", authn.Wrap(api))
+
+		var adminServer *http.Server
+		if cfg.AdminListen != "" {
+			adminServer = &http.Server{
+				Addr:    cfg.AdminListen,
+				Handler: adminMux,
+			}
+			if err := admin.Serve(adminServer); err != nil {
+				return err
+			}
+		} else {
+			if len(cfg.Auth.Tokens) == 0 {
+				log.Warn("no auth tokens, the admin endpoints are refused on the public listener")
+			}
+			cmdutil.MountAdmin(mux, adminMux, authn)
+		}
 
-		http.Handle("/metrics", exporter)
+		backendConf, backendCerts, err := cmdutil.ClientTLS(cfg.Backend.TLS)
+		if err != nil {
+			return err
+		}
 
-		lsys := storeutil.LinkSystemForBlockstore(client.New(cctx.String("server-addr")))
-		http.Handle(
+		hc := client.NewHTTPClient(backendConf, cfg.Backend.Token, cfg.Backend.Timeout)
+		cache := client.NewCache(cfg.Cache.Size, cfg.Cache.TTL)
+		c := client.New(cfg.Backend.Addr, hc).WithCache(cache)
+		c.SetNamespaces(cfg.Namespaces)
+		lsys := storeutil.LinkSystemForBlockstore(c)
+		// frisbii serves every request with the context it was built with, so
+		// build one per request to pass the request's cancellation and trace
+		// context on to the client
+		ipfs := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			frisbii.NewHttpIpfs(r.Context(), lsys, frisbii.WithCompressionLevel(gzip.NoCompression)).ServeHTTP(w, r)
+		})
+		api.Handle(
 			"/ipfs/",
-			frisbii.NewHttpIpfs(ctx, lsys, frisbii.WithCompressionLevel(gzip.NoCompression)),
+			middleware.Chain(
+				ipfs,
+				middleware.Instrument("ipfs"),
+				middleware.Trace("ipfs"),
+				middleware.Recover,
+			),
 		)
 
+		checker := health.New()
+		checker.Add("backend", c.Ping)
+		checker.Handle(adminMux)
+		// probes reach the public listener without a token
+		mux.HandleFunc("GET /healthz", checker.Healthz)
+		mux.HandleFunc("GET /readyz", checker.Readyz)
+
+		tlsConf, certs, err := cmdutil.ServerTLS(cfg.TLS)
+		if err != nil {
+			return err
+		}
+
+		accessLog := middleware.NewAccessLog(accessLogConfig(cfg.AccessLog), authn.Identify)
+		defer accessLog.Close()
+
+		limiter := middleware.NewLimiter(limits(cfg.Limits), authn.Identify)
+		tracker := &middleware.Tracker{}
+
 		server := &http.Server{
-			Addr: listen,
+			Addr:      cfg.Listen,
+			Handler:   middleware.Chain(mux, tracker.Wrap, middleware.RequestID, accessLog.Wrap, limiter.Wrap),
+			TLSConfig: tlsConf,
+		}
+
+		r := &reloader{
+			cctx:         cctx,
+			cfg:          cfg,
+			limiter:      limiter,
+			authn:        authn,
+			certs:        certs,
+			client:       c,
+			cache:        cache,
+			hc:           hc,
+			backendCerts: backendCerts,
 		}
+		cmdutil.ReloadOnSIGHUP(ctx, r.reload)
 
+		serveErr := make(chan error, 1)
 		go func() {
-			<-ctx.Done()
-			time.Sleep(time.Millisecond * 100)
-			log.Info("closed retrieve http")
-			server.Shutdown(ctx)
+			if tlsConf != nil {
+				log.Infow("serving https", "mtls", tlsConf.ClientCAs != nil)
+				serveErr <- server.ListenAndServeTLS("", "")
+				return
+			}
+			serveErr <- server.ListenAndServe()
 		}()
 
-		return server.ListenAndServe()
-	},
-}
+		select {
+		case err := <-serveErr:
+			return err
+		case <-ctx.Done():
+		}
 
-func setLog(debug bool) {
-	level := "INFO"
-	if debug {
-		level = "DEBUG"
-	}
+		log.Infow("shutting down", "drainDelay", cfg.DrainDelay.String(), "grace", cfg.ShutdownGrace.String(), "inFlight", tracker.Active())
+		checker.Drain()
+		cmdutil.Shutdown(server, cfg.DrainDelay, cfg.ShutdownGrace, tracker)
+		if adminServer != nil {
+			adminServer.Close()
+		}
+		log.Info("closed retrieve http")
 
-	logging.SetLogLevel("main", level)
-	logging.SetLogLevel("client", level)
+		return nil
+	},
 }
+
+var subsystems = []string{"main", "client", "middleware", "tlsutil", "tracing", "admin", "auth"}
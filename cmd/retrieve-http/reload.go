@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/gh-efforts/retrieve-server/auth"
+	"github.com/gh-efforts/retrieve-server/client"
+	"github.com/gh-efforts/retrieve-server/cmd/internal/cmdutil"
+	"github.com/gh-efforts/retrieve-server/config"
+	"github.com/gh-efforts/retrieve-server/middleware"
+	"github.com/gh-efforts/retrieve-server/tlsutil"
+	"github.com/urfave/cli/v2"
+)
+
+// reloader applies the settings that can change without restarting the
+// listeners: log levels, limits, auth tokens, the backend, the namespaces
+// served, the cache, the certificate pairs and the CA bundles.
+type reloader struct {
+	cctx *cli.Context
+	cfg  *config.HTTP
+
+	limiter *middleware.Limiter
+	authn   *auth.Authenticator
+	certs   *tlsutil.Reloader
+
+	client       *client.Client
+	cache        *client.Cache
+	hc           *http.Client
+	backendCerts *tlsutil.Reloader
+}
+
+func (r *reloader) reload() {
+	cfg, err := loadConfig(r.cctx)
+	if err != nil {
+		log.Errorw("reload config", "err", err)
+		return
+	}
+
+	applied := *r.cfg
+
+	if err := cmdutil.SetLog(cfg.Log, subsystems); err != nil {
+		log.Errorw("reload log config", "err", err)
+		cmdutil.SetLog(applied.Log, subsystems)
+	} else {
+		applied.Log = cfg.Log
+	}
+
+	r.limiter.SetLimits(limits(cfg.Limits))
+	applied.Limits = cfg.Limits
+
+	r.authn.SetTokens(authTokens(cfg.Auth), cfg.Auth.AnonymousRead)
+	applied.Auth = cfg.Auth
+
+	r.cache.Resize(cfg.Cache.Size)
+	r.cache.SetTTL(cfg.Cache.TTL)
+	applied.Cache = cfg.Cache
+
+	if r.certs != nil {
+		if err := r.certs.SetFiles(cfg.TLS.Cert, cfg.TLS.Key); err != nil {
+			log.Errorw("reload certificate", "err", err)
+		} else {
+			applied.TLS.Cert, applied.TLS.Key = cfg.TLS.Cert, cfg.TLS.Key
+		}
+
+		// turning mTLS on or off needs a restart, the bundle can change
+		if applied.TLS.ClientCA != "" && cfg.TLS.ClientCA != "" {
+			if err := r.certs.SetClientCA(cfg.TLS.ClientCA); err != nil {
+				log.Errorw("reload client CA", "err", err)
+			} else {
+				applied.TLS.ClientCA = cfg.TLS.ClientCA
+			}
+		}
+	}
+
+	// the client verifies the backend against the CA bundle it was built
+	// with, so a bundle is re-read by building a new one
+	if cfg.Backend != applied.Backend || cfg.Backend.TLS.CA != "" {
+		if err := r.setBackend(cfg.Backend); err != nil {
+			log.Errorw("reload backend", "err", err)
+		} else {
+			applied.Backend = cfg.Backend
+		}
+	} else if r.backendCerts != nil {
+		if err := r.backendCerts.Reload(); err != nil {
+			log.Errorw("reload backend certificate", "err", err)
+		}
+	}
+
+	if !slices.Equal(cfg.Namespaces, applied.Namespaces) {
+		r.client.SetNamespaces(cfg.Namespaces)
+		applied.Namespaces = cfg.Namespaces
+	}
+
+	cmdutil.LogChanges(r.cfg, &applied, cfg)
+	*r.cfg = applied
+}
+
+// setBackend points the client at a new backend, idle connections to the
+// old one are closed and requests in flight finish on them.
+func (r *reloader) setBackend(b config.Backend) error {
+	conf, certs, err := cmdutil.ClientTLS(b.TLS)
+	if err != nil {
+		return err
+	}
+
+	hc := client.NewHTTPClient(conf, b.Token, b.Timeout)
+	r.client.SetBackend(b.Addr, hc)
+	if r.hc != hc {
+		r.hc.CloseIdleConnections()
+	}
+	r.hc, r.backendCerts = hc, certs
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import "github.com/urfave/cli/v2"
+
+var tlsFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "tls-cert",
+		Usage: "certificate file, serve https when set together with --tls-key",
+	},
+	&cli.StringFlag{
+		Name:  "tls-key",
+		Usage: "private key file for --tls-cert",
+	},
+	&cli.StringFlag{
+		Name:  "tls-client-ca",
+		Usage: "require client certificates signed by this CA bundle (mTLS)",
+	},
+	&cli.StringFlag{
+		Name:  "server-tls-ca",
+		Usage: "CA bundle used to verify the retrieve server certificate",
+	},
+	&cli.StringFlag{
+		Name:  "server-tls-cert",
+		Usage: "client certificate presented to the retrieve server (mTLS)",
+	},
+	&cli.StringFlag{
+		Name:  "server-tls-key",
+		Usage: "private key file for --server-tls-cert",
+	},
+	&cli.StringFlag{
+		Name:  "server-token",
+		Usage: "bearer token sent to the retrieve server",
+	},
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gh-efforts/retrieve-server/client"
+	"github.com/gh-efforts/retrieve-server/cmd/internal/cmdutil"
+	"github.com/urfave/cli/v2"
+)
+
+var backupCmd = &cli.Command{
+	Name:      "backup",
+	Usage:     "Copy the db of a running server to a new directory in the backup_dir of its db config",
+	ArgsUsage: "<name>",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "server-addr",
+			Value: "127.0.0.1:9876",
+			Usage: "address serving the admin endpoints, the admin listen address when one is set",
+		},
+	}, clientTLSFlags...),
+	Action: func(cctx *cli.Context) error {
+		if cctx.NArg() != 1 {
+			return fmt.Errorf("expected the backup name")
+		}
+		dir := cctx.Args().First()
+
+		hc, err := cmdutil.NewHTTPClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if err := client.Backup(cctx.Context, hc, cctx.String("server-addr"), dir); err != nil {
+			return err
+		}
+
+		fmt.Printf("backed up to %s in the backup dir\n", dir)
+		return nil
+	},
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gh-efforts/retrieve-server/db"
+	"github.com/urfave/cli/v2"
+)
+
+var dbCmd = &cli.Command{
+	Name:  "db",
+	Usage: "manage the db schema",
+	Flags: []cli.Flag{
+		configFlag,
+		&cli.StringFlag{
+			Name:  "db",
+			Value: defaults.DB.Path,
+		},
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:  "migrate",
+			Usage: "apply the pending schema migrations",
+			Action: func(cctx *cli.Context) error {
+				d, err := openDB(cctx)
+				if err != nil {
+					return err
+				}
+				defer d.Close()
+
+				applied, err := d.Migrate(cctx.Context)
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("applied %d migrations, schema version %d\n", applied, db.SchemaLatest())
+				return nil
+			},
+		},
+		{
+			Name:  "version",
+			Usage: "print the schema version of the db and the one this release runs against",
+			Action: func(cctx *cli.Context) error {
+				d, err := openDB(cctx)
+				if err != nil {
+					return err
+				}
+				defer d.Close()
+
+				version, err := d.SchemaVersion(cctx.Context)
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("db: %d\nsupported: %d\n", version, db.SchemaLatest())
+				return nil
+			},
+		},
+	},
+}
+
+// openDB connects to the db of the run config without checking its schema.
+func openDB(cctx *cli.Context) (*db.DB, error) {
+	cfg, err := loadConfig(cctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.Open(cfg.DB.Path, db.Options{})
+}
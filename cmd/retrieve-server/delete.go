@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gh-efforts/retrieve-server/client"
+	"github.com/gh-efforts/retrieve-server/cmd/internal/cmdutil"
+	"github.com/urfave/cli/v2"
+)
+
+// roots of a list file sent per request, the server limits the body size
+const listChunk = 10000
+
+var bulkDeleteCmd = &cli.Command{
+	Name:  "bulk-delete",
+	Usage: "Delete the roots matching a filter, all given conditions have to match",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "server-addr",
+			Value: "127.0.0.1:9876",
+			Usage: "address serving the admin endpoints, the admin listen address when one is set",
+		},
+		&cli.StringFlag{
+			Name:  "list",
+			Usage: "file with one root per line, - reads stdin",
+		},
+		&cli.StringFlag{
+			Name:  "provider",
+			Usage: "roots with a deal with this storage provider",
+		},
+		&cli.StringFlag{
+			Name:  "piece-cid",
+			Usage: "roots stored in this piece",
+		},
+		&cli.TimestampFlag{
+			Name:   "created-before",
+			Layout: time.RFC3339,
+			Usage:  "roots created before this RFC 3339 time",
+		},
+		&cli.Int64Flag{
+			Name:  "min-size",
+			Usage: "roots of at least this many bytes",
+		},
+		&cli.Int64Flag{
+			Name:  "max-size",
+			Usage: "roots of at most this many bytes",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "only report how many roots and bytes would be deleted",
+		},
+		&cli.IntFlag{
+			Name:  "batch-size",
+			Value: 1000,
+			Usage: "roots deleted per transaction",
+		},
+	}, clientTLSFlags...),
+	Action: func(cctx *cli.Context) error {
+		hc, err := cmdutil.NewHTTPClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		f := client.DeleteFilter{
+			Provider:      cctx.String("provider"),
+			PieceCid:      cctx.String("piece-cid"),
+			CreatedBefore: cctx.Timestamp("created-before"),
+			DryRun:        cctx.Bool("dry-run"),
+			BatchSize:     cctx.Int("batch-size"),
+		}
+		if cctx.IsSet("min-size") {
+			v := cctx.Int64("min-size")
+			f.MinSize = &v
+		}
+		if cctx.IsSet("max-size") {
+			v := cctx.Int64("max-size")
+			f.MaxSize = &v
+		}
+
+		var chunks [][]string
+		if path := cctx.String("list"); path != "" {
+			roots, err := readList(path)
+			if err != nil {
+				return err
+			}
+			if len(roots) == 0 {
+				return fmt.Errorf("no roots in %s", path)
+			}
+			for len(roots) > 0 {
+				n := min(listChunk, len(roots))
+				chunks = append(chunks, roots[:n])
+				roots = roots[n:]
+			}
+		} else {
+			chunks = [][]string{nil}
+		}
+
+		var total client.DeleteResult
+		for _, chunk := range chunks {
+			f.Roots = chunk
+			res, err := client.BulkDelete(cctx.Context, hc, cctx.String("server-addr"), &f)
+			if err != nil {
+				return fmt.Errorf("after %d roots: %w", total.Roots, err)
+			}
+			total.Roots += res.Roots
+			total.Bytes += res.Bytes
+		}
+
+		verb := "deleted"
+		if f.DryRun {
+			verb = "would delete"
+		}
+		fmt.Printf("%s %d roots, %d bytes\n", verb, total.Roots, total.Bytes)
+		return nil
+	},
+}
+
+// readList reads one root per line, blank lines and lines starting with #
+// are skipped.
+func readList(path string) ([]string, error) {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var roots []string
+	sc := bufio.NewScanner(in)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		roots = append(roots, line)
+	}
+
+	return roots, sc.Err()
+}
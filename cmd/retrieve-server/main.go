@@ -1,19 +1,26 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
 	"time"
 
-	_ "net/http/pprof"
-
 	"contrib.go.opencensus.io/exporter/prometheus"
-	cliutil "github.com/filecoin-project/lotus/cli/util"
+	"github.com/gh-efforts/retrieve-server/admin"
+	"github.com/gh-efforts/retrieve-server/auth"
 	"github.com/gh-efforts/retrieve-server/build"
+	"github.com/gh-efforts/retrieve-server/cmd/internal/cmdutil"
 	"github.com/gh-efforts/retrieve-server/db"
+	"github.com/gh-efforts/retrieve-server/health"
 	"github.com/gh-efforts/retrieve-server/metrics"
+	"github.com/gh-efforts/retrieve-server/middleware"
 	"github.com/gh-efforts/retrieve-server/server"
-	"github.com/mitchellh/go-homedir"
+	"github.com/gh-efforts/retrieve-server/tracing"
 
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/urfave/cli/v2"
@@ -28,8 +35,13 @@ func main() {
 	local := []*cli.Command{
 		runCmd,
 		postCmd,
+		bulkDeleteCmd,
+		backupCmd,
 		migrateCmd,
 		pprofCmd,
+		cmdutil.LogCmd("retrieve-server", "127.0.0.1:9877", "RSERVER"),
+		configCmd,
+		dbCmd,
 	}
 
 	app := &cli.App{
@@ -46,26 +58,83 @@ func main() {
 
 var runCmd = &cli.Command{
 	Name: "run",
-	Flags: []cli.Flag{
+	Flags: flags([]cli.Flag{
+		configFlag,
 		&cli.StringFlag{
 			Name:  "listen",
-			Value: "0.0.0.0:9876",
+			Value: defaults.Listen,
+		},
+		&cli.StringFlag{
+			Name:  "admin-listen",
+			Value: defaults.AdminListen,
+			Usage: "address for pprof, metrics and health probes, which are not served on --listen unless this is empty",
 		},
 		&cli.BoolFlag{
 			Name:  "debug",
 			Value: false,
 		},
+		&cli.DurationFlag{
+			Name:  "drain-delay",
+			Value: defaults.DrainDelay,
+			Usage: "how long shutdown keeps serving with readiness failing before closing the listener",
+		},
+		&cli.DurationFlag{
+			Name:  "shutdown-grace",
+			Value: defaults.ShutdownGrace,
+			Usage: "how long shutdown waits for requests in flight before aborting them",
+		},
 		&cli.StringFlag{
 			Name:  "db",
-			Value: "./rserver.db",
+			Value: defaults.DB.Path,
 		},
-	},
+		&cli.IntFlag{
+			Name:  "block-profile-rate",
+			Usage: "sample one blocking event per this many nanoseconds blocked, 0 disables the block profile",
+		},
+		&cli.IntFlag{
+			Name:  "mutex-profile-fraction",
+			Usage: "sample one in this many mutex contention events, 0 disables the mutex profile",
+		},
+		&cli.Int64Flag{
+			Name:  "max-block-size",
+			Value: defaults.Uploads.MaxBlockSize,
+			Usage: "largest root block accepted, in bytes",
+		},
+		&cli.Int64Flag{
+			Name:  "max-body-size",
+			Value: defaults.Uploads.MaxBodySize,
+			Usage: "largest json upload body accepted, in bytes",
+		},
+		&cli.Int64Flag{
+			Name:  "max-car-size",
+			Value: defaults.Uploads.MaxCarSize,
+			Usage: "largest car upload body accepted, in bytes",
+		},
+	}, serverTLSFlags, limitFlags, accessLogFlags, tracingFlags),
 	Action: func(cctx *cli.Context) error {
-		setLog(cctx.Bool("debug"))
+		cfg, err := loadConfig(cctx)
+		if err != nil {
+			return err
+		}
+
+		if err := cmdutil.SetLog(cfg.Log, subsystems); err != nil {
+			return err
+		}
 
 		log.Info("starting retrieve server ...")
 
-		ctx := cliutil.ReqContext(cctx)
+		runtime.SetBlockProfileRate(cfg.Profiling.BlockProfileRate)
+		runtime.SetMutexProfileFraction(cfg.Profiling.MutexProfileFraction)
+
+		// SIGHUP reloads the config, so only SIGINT and SIGTERM stop the server
+		ctx, stop := signal.NotifyContext(cctx.Context, syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		shutdownTracing, err := tracing.Setup(ctx, "retrieve-server", tracingConfig(cfg.Tracing))
+		if err != nil {
+			return err
+		}
+		defer shutdownTracing(context.Background())
 
 		exporter, err := prometheus.NewExporter(prometheus.Options{
 			Namespace: "rserver",
@@ -85,50 +154,131 @@ var runCmd = &cli.Command{
 		}
 		stats.Record(ctx, metrics.Info.M(1))
 
-		listen := cctx.String("listen")
-		log.Infow("retrieve server", "listen", listen)
+		log.Infow("retrieve server", "listen", cfg.Listen)
 
-		http.Handle("/metrics", exporter)
+		mux := http.NewServeMux()
+		api := http.NewServeMux()
+		adminMux := admin.NewMux(exporter)
 
-		path, err := homedir.Expand(cctx.String("db"))
+		log.Infof("db path: %s", cfg.DB.Path)
+
+		d, err := db.OpenDB(cfg.DB.Path, db.Options{
+			MaxOpenConns:    cfg.DB.MaxOpenConns,
+			MaxIdleConns:    cfg.DB.MaxIdleConns,
+			ConnMaxLifetime: cfg.DB.ConnMaxLifetime,
+			ConnMaxIdleTime: cfg.DB.ConnMaxIdleTime,
+			AutoMigrate:     cfg.DB.AutoMigrate,
+		})
 		if err != nil {
 			return err
 		}
-		log.Infof("db path: %s", path)
+		defer d.Close()
+		go d.RecordStats(ctx, 10*time.Second)
+
+		srv := server.New(d, server.Options{
+			MaxBlockSize: cfg.Uploads.MaxBlockSize,
+			MaxBodySize:  cfg.Uploads.MaxBodySize,
+			MaxCarSize:   cfg.Uploads.MaxCarSize,
+			Quotas:       quotas(cfg.Quotas),
+			BackupDir:    cfg.DB.BackupDir,
+		})
+		srv.Handle(api)
+		srv.HandleAdmin(adminMux)
+		go srv.RecordUsage(ctx, time.Minute)
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.RunReaper(ctx, server.ReaperOptions{
+				Interval:   cfg.Retention.ReapInterval,
+				BatchSize:  cfg.Retention.BatchSize,
+				ArchiveDir: cfg.Retention.ArchiveDir,
+				PurgeDelay: cfg.Retention.PurgeDelay,
+			})
+		}()
+
+		authn := auth.New(authTokens(cfg.Auth), cfg.Auth.AnonymousRead)
+		mux.Handle("/", authn.Wrap(api))
+
+		checker := health.New()
+		checker.Add("db", d.Ping)
+		checker.Add("schema", d.CheckSchema)
+		checker.Handle(adminMux)
+		// probes reach the public listener without a token
+		mux.HandleFunc("GET /healthz", checker.Healthz)
+		mux.HandleFunc("GET /readyz", checker.Readyz)
+
+		var adminServer *http.Server
+		if cfg.AdminListen != "" {
+			adminServer = &http.Server{
+				Addr:    cfg.AdminListen,
+				Handler: auth.WithIdentity(auth.AdminListener, adminMux),
+			}
+			if err := admin.Serve(adminServer); err != nil {
+				return err
+			}
+		} else {
+			if len(cfg.Auth.Tokens) == 0 {
+				log.Warn("no auth tokens, the admin endpoints are refused on the public listener")
+			}
+			cmdutil.MountAdmin(mux, adminMux, authn)
+		}
 
-		d, err := db.OpenDB(path)
+		tlsConf, certs, err := cmdutil.ServerTLS(cfg.TLS)
 		if err != nil {
 			return err
 		}
-		defer d.DB.Close()
 
-		server.New(d).Handle()
+		accessLog := middleware.NewAccessLog(accessLogConfig(cfg.AccessLog), authn.Identify)
+		defer accessLog.Close()
+
+		limiter := middleware.NewLimiter(limits(cfg.Limits), authn.Identify)
+		tracker := &middleware.Tracker{}
 
 		server := &http.Server{
-			Addr: listen,
+			Addr:      cfg.Listen,
+			Handler:   middleware.Chain(mux, tracker.Wrap, middleware.RequestID, accessLog.Wrap, limiter.Wrap),
+			TLSConfig: tlsConf,
+		}
+
+		r := &reloader{
+			cctx:    cctx,
+			cfg:     cfg,
+			limiter: limiter,
+			authn:   authn,
+			certs:   certs,
+			srv:     srv,
 		}
+		cmdutil.ReloadOnSIGHUP(ctx, r.reload)
 
+		serveErr := make(chan error, 1)
 		go func() {
-			<-ctx.Done()
-			time.Sleep(time.Millisecond * 100)
-			log.Info("closed retrieve server")
-			server.Shutdown(ctx)
+			if tlsConf != nil {
+				log.Infow("serving https", "mtls", tlsConf.ClientCAs != nil)
+				serveErr <- server.ListenAndServeTLS("", "")
+				return
+			}
+			serveErr <- server.ListenAndServe()
 		}()
 
-		return server.ListenAndServe()
-	},
-}
+		select {
+		case err := <-serveErr:
+			return err
+		case <-ctx.Done():
+		}
 
-func setLog(debug bool) {
-	level := "INFO"
-	if debug {
-		level = "DEBUG"
-	}
+		log.Infow("shutting down", "drainDelay", cfg.DrainDelay.String(), "grace", cfg.ShutdownGrace.String(), "inFlight", tracker.Active())
+		checker.Drain()
+		cmdutil.Shutdown(server, cfg.DrainDelay, cfg.ShutdownGrace, tracker)
+		if adminServer != nil {
+			adminServer.Close()
+		}
+		wg.Wait()
+		log.Info("closed retrieve server")
 
-	logging.SetLogLevel("main", level)
-	logging.SetLogLevel("db", level)
-	logging.SetLogLevel("metrics", level)
-	logging.SetLogLevel("server", level)
-	logging.SetLogLevel("middleware", level)
-	logging.SetLogLevel("client", level)
+		return nil
+	},
 }
+
+var subsystems = []string{"main", "db", "metrics", "server", "middleware", "client", "tlsutil", "tracing", "admin", "auth"}
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 
+	"github.com/gh-efforts/retrieve-server/cmd/internal/cmdutil"
+	"github.com/gh-efforts/retrieve-server/config"
 	"github.com/gh-efforts/retrieve-server/db"
 	"github.com/urfave/cli/v2"
 )
@@ -10,7 +12,7 @@ import (
 var migrateCmd = &cli.Command{
 	Name:      "migrate",
 	Usage:     "<sqlite-db> <yugabyte-dsn>",
-	UsageText: "migrate sqlite db to yugabyte db",
+	UsageText: "migrate sqlite db to yugabyte db, the sqlite db is upgraded to the current schema first; namespaces, expiries, deals, deleted roots and the audit log are copied, pebble:// and flatfs:// blocks are read from their store",
 	Flags: []cli.Flag{
 		&cli.BoolFlag{
 			Name:  "debug",
@@ -18,7 +20,13 @@ var migrateCmd = &cli.Command{
 		},
 	},
 	Action: func(cctx *cli.Context) error {
-		setLog(cctx.Bool("debug"))
+		lc := config.Log{Level: "info"}
+		if cctx.Bool("debug") {
+			lc.Level = "debug"
+		}
+		if err := cmdutil.SetLog(lc, subsystems); err != nil {
+			return err
+		}
 
 		if cctx.Args().Len() < 2 {
 			return fmt.Errorf("args < 2")
@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/gh-efforts/retrieve-server/client"
+	"github.com/gh-efforts/retrieve-server/cmd/internal/cmdutil"
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-car/v2/blockstore"
 	"github.com/urfave/cli/v2"
@@ -13,13 +15,45 @@ import (
 var postCmd = &cli.Command{
 	Name:  "post",
 	Usage: "<file.car> <block cid>",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:  "server-addr",
 			Value: "127.0.0.1:9876",
+			Usage: "host:port, or a url such as https://host:port",
 		},
-	},
+		&cli.BoolFlag{
+			Name:  "stream",
+			Usage: "stream the car file to the server instead of reading the block locally, the block cid defaults to the car roots",
+		},
+	}, clientTLSFlags...),
 	Action: func(cctx *cli.Context) error {
+		hc, err := cmdutil.NewHTTPClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		if cctx.Bool("stream") {
+			if cctx.Args().Len() < 1 {
+				return fmt.Errorf("args < 1")
+			}
+
+			f, err := os.Open(cctx.Args().Get(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			stored, err := client.PostCar(cctx.Context, hc, cctx.String("server-addr"), f, cctx.Args().Tail())
+			if err != nil {
+				return err
+			}
+
+			for _, root := range stored {
+				fmt.Println(root)
+			}
+			return nil
+		}
+
 		if cctx.Args().Len() < 2 {
 			return fmt.Errorf("args < 2")
 		}
@@ -39,6 +73,6 @@ var postCmd = &cli.Command{
 			return err
 		}
 
-		return client.PostRootBlock(cctx.String("server-addr"), cid.String(), block.RawData())
+		return client.PostRootBlock(cctx.Context, hc, cctx.String("server-addr"), cid.String(), block.RawData())
 	},
 }
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
 	"io"
-	"net/http"
 	"os"
+	"time"
 
+	"github.com/gh-efforts/retrieve-server/build"
+	"github.com/gh-efforts/retrieve-server/client"
+	"github.com/gh-efforts/retrieve-server/cmd/internal/cmdutil"
 	"github.com/urfave/cli/v2"
 )
 
@@ -12,31 +19,211 @@ var pprofCmd = &cli.Command{
 	Name: "pprof",
 	Subcommands: []*cli.Command{
 		pprofGoroutines,
+		pprofProfile("heap", "Save a heap profile of live objects", "heap"),
+		pprofProfile("allocs", "Save a profile of all past allocations", "allocs"),
+		pprofProfile("block", "Save a blocking profile, needs --block-profile-rate on the server", "block"),
+		pprofProfile("mutex", "Save a mutex contention profile, needs --mutex-profile-fraction on the server", "mutex"),
+		pprofTimed("cpu", "Save a cpu profile", "profile", 30*time.Second),
+		pprofTimed("trace", "Save an execution trace", "trace", 5*time.Second),
+		pprofBundle,
 	},
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.StringFlag{
 			Name:  "connect",
-			Value: "127.0.0.1:9876",
+			Value: "127.0.0.1:9877",
+			Usage: "address serving the admin endpoints of the retrieve server, a url such as https://host:port for tls",
 		},
-	},
+	}, clientTLSFlags...),
 }
 
 var pprofGoroutines = &cli.Command{
 	Name:  "goroutines",
 	Usage: "Get goroutine stacks",
+	Action: func(cctx *cli.Context) error {
+		hc, err := cmdutil.NewHTTPClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		stacks, err := client.GetProfile(cctx.Context, hc, cctx.String("connect"), "/debug/pprof/goroutine?debug=2")
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stdout.Write(stacks)
+		return err
+	},
+}
+
+// pprofProfile saves a snapshot profile served at /debug/pprof/<profile>.
+func pprofProfile(name, usage, profile string) *cli.Command {
+	return &cli.Command{
+		Name:  name,
+		Usage: usage,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "file to save the profile to, defaults to <name>-<time>.pb.gz",
+			},
+		},
+		Action: func(cctx *cli.Context) error {
+			return saveProfile(cctx, name, "/debug/pprof/"+profile, ".pb.gz")
+		},
+	}
+}
+
+// pprofTimed saves a profile that is recorded over --duration.
+func pprofTimed(name, usage, profile string, duration time.Duration) *cli.Command {
+	ext := ".pb.gz"
+	if profile == "trace" {
+		ext = ".out"
+	}
+
+	return &cli.Command{
+		Name:  name,
+		Usage: usage,
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:  "duration",
+				Value: duration,
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Usage: "file to save the profile to, defaults to <name>-<time>" + ext,
+			},
+		},
+		Action: func(cctx *cli.Context) error {
+			path := fmt.Sprintf("/debug/pprof/%s?seconds=%d", profile, durationSeconds(cctx.Duration("duration")))
+			return saveProfile(cctx, name, path, ext)
+		},
+	}
+}
+
+var pprofBundle = &cli.Command{
+	Name:  "bundle",
+	Usage: "Collect goroutines, heap, allocs, block, mutex, cpu and trace profiles with build versions into a tarball",
+	Flags: []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "cpu-duration",
+			Value: 30 * time.Second,
+		},
+		&cli.DurationFlag{
+			Name:  "trace-duration",
+			Value: 5 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "tarball to write, defaults to pprof-bundle-<time>.tar.gz",
+		},
+	},
 	Action: func(cctx *cli.Context) error {
 		connect := cctx.String("connect")
-		addr := "http://" + connect + "/debug/pprof/goroutine?debug=2"
+		hc, err := cmdutil.NewHTTPClient(cctx)
+		if err != nil {
+			return err
+		}
+
+		output := cctx.String("output")
+		if output == "" {
+			output = fmt.Sprintf("pprof-bundle-%s.tar.gz", time.Now().Format("20060102-150405"))
+		}
 
-		r, err := http.Get(addr)
+		f, err := os.Create(output)
 		if err != nil {
 			return err
 		}
+		defer f.Close()
+
+		gw := gzip.NewWriter(f)
+		tw := tar.NewWriter(gw)
 
-		if _, err := io.Copy(os.Stdout, r.Body); err != nil {
+		serverVersion, err := client.GetVersion(cctx.Context, hc, connect)
+		if err != nil {
 			return err
 		}
+		version := fmt.Sprintf("server: %s\ncli: %s\n", serverVersion, build.UserVersion())
+		if err := addTarFile(tw, "version.txt", []byte(version)); err != nil {
+			return err
+		}
+
+		profiles := []struct {
+			file string
+			path string
+		}{
+			{"goroutines.txt", "/debug/pprof/goroutine?debug=2"},
+			{"heap.pb.gz", "/debug/pprof/heap"},
+			{"allocs.pb.gz", "/debug/pprof/allocs"},
+			{"block.pb.gz", "/debug/pprof/block"},
+			{"mutex.pb.gz", "/debug/pprof/mutex"},
+			{"cpu.pb.gz", fmt.Sprintf("/debug/pprof/profile?seconds=%d", durationSeconds(cctx.Duration("cpu-duration")))},
+			{"trace.out", fmt.Sprintf("/debug/pprof/trace?seconds=%d", durationSeconds(cctx.Duration("trace-duration")))},
+		}
+		for _, p := range profiles {
+			fmt.Fprintf(os.Stderr, "collecting %s\n", p.file)
 
-		return r.Body.Close()
+			data, err := client.GetProfile(cctx.Context, hc, connect, p.path)
+			if err != nil {
+				return fmt.Errorf("%s: %w", p.file, err)
+			}
+			if err := addTarFile(tw, p.file, data); err != nil {
+				return err
+			}
+		}
+
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return err
+		}
+
+		fmt.Println(output)
+		return nil
 	},
 }
+
+func saveProfile(cctx *cli.Context, name, path, ext string) error {
+	hc, err := cmdutil.NewHTTPClient(cctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := client.GetProfile(cctx.Context, hc, cctx.String("connect"), path)
+	if err != nil {
+		return err
+	}
+
+	output := cctx.String("output")
+	if output == "" {
+		output = fmt.Sprintf("%s-%s%s", name, time.Now().Format("20060102-150405"), ext)
+	}
+
+	if err := os.WriteFile(output, data, 0644); err != nil {
+		return err
+	}
+
+	fmt.Println(output)
+	return nil
+}
+
+func addTarFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, bytes.NewReader(data))
+	return err
+}
+
+func durationSeconds(d time.Duration) int {
+	if d < time.Second {
+		return 1
+	}
+	return int(d / time.Second)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/gh-efforts/retrieve-server/auth"
+	"github.com/gh-efforts/retrieve-server/cmd/internal/cmdutil"
+	"github.com/gh-efforts/retrieve-server/config"
+	"github.com/gh-efforts/retrieve-server/middleware"
+	"github.com/gh-efforts/retrieve-server/server"
+	"github.com/gh-efforts/retrieve-server/tlsutil"
+	"github.com/urfave/cli/v2"
+)
+
+// reloader applies the settings that can change without restarting the
+// listeners: log levels, limits, auth tokens, quotas, profiling rates, the
+// certificate pair and the client CA bundle.
+type reloader struct {
+	cctx *cli.Context
+	cfg  *config.Server
+
+	limiter *middleware.Limiter
+	authn   *auth.Authenticator
+	certs   *tlsutil.Reloader
+	srv     *server.Server
+}
+
+func (r *reloader) reload() {
+	cfg, err := loadConfig(r.cctx)
+	if err != nil {
+		log.Errorw("reload config", "err", err)
+		return
+	}
+
+	applied := *r.cfg
+
+	if err := cmdutil.SetLog(cfg.Log, subsystems); err != nil {
+		log.Errorw("reload log config", "err", err)
+		cmdutil.SetLog(applied.Log, subsystems)
+	} else {
+		applied.Log = cfg.Log
+	}
+
+	r.limiter.SetLimits(limits(cfg.Limits))
+	applied.Limits = cfg.Limits
+
+	r.authn.SetTokens(authTokens(cfg.Auth), cfg.Auth.AnonymousRead)
+	applied.Auth = cfg.Auth
+
+	r.srv.SetQuotas(quotas(cfg.Quotas))
+	applied.Quotas = cfg.Quotas
+
+	runtime.SetBlockProfileRate(cfg.Profiling.BlockProfileRate)
+	runtime.SetMutexProfileFraction(cfg.Profiling.MutexProfileFraction)
+	applied.Profiling = cfg.Profiling
+
+	if r.certs != nil {
+		if err := r.certs.SetFiles(cfg.TLS.Cert, cfg.TLS.Key); err != nil {
+			log.Errorw("reload certificate", "err", err)
+		} else {
+			applied.TLS.Cert, applied.TLS.Key = cfg.TLS.Cert, cfg.TLS.Key
+		}
+
+		// turning mTLS on or off needs a restart, the bundle can change
+		if applied.TLS.ClientCA != "" && cfg.TLS.ClientCA != "" {
+			if err := r.certs.SetClientCA(cfg.TLS.ClientCA); err != nil {
+				log.Errorw("reload client CA", "err", err)
+			} else {
+				applied.TLS.ClientCA = cfg.TLS.ClientCA
+			}
+		}
+	}
+
+	cmdutil.LogChanges(r.cfg, &applied, cfg)
+	*r.cfg = applied
+}
@@ -0,0 +1,5 @@
+package main
+
+import "github.com/gh-efforts/retrieve-server/cmd/internal/cmdutil"
+
+var clientTLSFlags = cmdutil.ClientFlags("RSERVER")
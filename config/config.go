@@ -0,0 +1,245 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+type Log struct {
+	Level      string            `toml:"level" comment:"level of the retrieve subsystems: debug, info, warn or error"`
+	Format     string            `toml:"format" comment:"color, nocolor or json, empty keeps the GOLOG_LOG_FMT default"`
+	Subsystems map[string]string `toml:"subsystems" comment:"per-subsystem levels overriding level, e.g. { server = \"debug\" }"`
+}
+
+type DB struct {
+	Path            string        `toml:"path" comment:"sqlite file path, a pebble:///dir or flatfs:///dir keeping blocks in dir/blocks and metadata in dir/meta.db (flatfs takes ?sync=false and ?shard=<width>), or a postgres:// or yugabyte:// dsn"`
+	MaxOpenConns    int           `toml:"max_open_conns" comment:"postgres connection pool size, 0 is unlimited; sqlite always uses one connection"`
+	MaxIdleConns    int           `toml:"max_idle_conns" comment:"idle postgres connections kept in the pool"`
+	ConnMaxLifetime time.Duration `toml:"conn_max_lifetime" comment:"close postgres connections after this long, 0 keeps them"`
+	ConnMaxIdleTime time.Duration `toml:"conn_max_idle_time" comment:"close postgres connections idle for this long, 0 keeps them"`
+	AutoMigrate     bool          `toml:"auto_migrate" comment:"apply pending schema migrations on start, otherwise run them with the db migrate command"`
+	BackupDir       string        `toml:"backup_dir" comment:"directory online backups are written to, each backup is a new directory in it; empty disables online backups"`
+}
+
+type TLS struct {
+	Cert     string `toml:"cert" comment:"certificate file, serve https when set together with key"`
+	Key      string `toml:"key" comment:"private key file for cert"`
+	ClientCA string `toml:"client_ca" comment:"require client certificates signed by this CA bundle (mTLS)"`
+}
+
+type ClientTLS struct {
+	CA   string `toml:"ca" comment:"CA bundle used to verify the server certificate, empty uses the system roots"`
+	Cert string `toml:"cert" comment:"client certificate presented to the server (mTLS)"`
+	Key  string `toml:"key" comment:"private key file for cert"`
+}
+
+type Limits struct {
+	Rate         float64       `toml:"rate" comment:"requests per second allowed for each client ip or token, 0 disables"`
+	Burst        int           `toml:"burst" comment:"burst size of the per-client rate limit"`
+	MaxInFlight  int           `toml:"max_in_flight" comment:"requests served at once, 0 disables the cap"`
+	MaxQueue     int           `toml:"max_queue" comment:"requests waiting for an in-flight slot before answering 429"`
+	QueueTimeout time.Duration `toml:"queue_timeout" comment:"how long a queued request waits for an in-flight slot"`
+}
+
+type Uploads struct {
+	MaxBlockSize int64 `toml:"max_block_size" comment:"largest root block accepted, in bytes"`
+	MaxBodySize  int64 `toml:"max_body_size" comment:"largest json upload body accepted, in bytes"`
+	MaxCarSize   int64 `toml:"max_car_size" comment:"largest car upload body accepted, in bytes, blocks other than the roots count too"`
+}
+
+type AccessLog struct {
+	Output     string  `toml:"output" comment:"stdout, stderr or a file path rotated by size"`
+	SampleRate float64 `toml:"sample_rate" comment:"fraction of successful requests written, failed requests are always written"`
+	MaxSizeMB  int     `toml:"max_size_mb" comment:"megabytes a file grows to before it is rotated"`
+	MaxBackups int     `toml:"max_backups" comment:"rotated files to keep, 0 keeps all"`
+	MaxAgeDays int     `toml:"max_age_days" comment:"days to keep rotated files, 0 keeps them forever"`
+}
+
+type Tracing struct {
+	Exporter    string  `toml:"exporter" comment:"export opentelemetry spans: otlp or stdout, empty disables tracing"`
+	Endpoint    string  `toml:"endpoint" comment:"host:port of the otlp http collector"`
+	Insecure    bool    `toml:"insecure" comment:"send spans to the otlp collector over plain http"`
+	SampleRatio float64 `toml:"sample_ratio" comment:"fraction of new traces sampled, traces started upstream follow the caller's decision"`
+}
+
+type Token struct {
+	Token    string   `toml:"token"`
+	Identity string   `toml:"identity"`
+	Scopes   []string `toml:"scopes"`
+}
+
+type Auth struct {
+	AnonymousRead bool    `toml:"anonymous_read" comment:"allow reads without a token when tokens are configured"`
+	Tokens        []Token `toml:"tokens" comment:"bearer tokens, auth is disabled when there are none; scopes are read, write and admin, read:ns and write:ns grant them in namespace ns only"`
+}
+
+type Retention struct {
+	ReapInterval time.Duration `toml:"reap_interval" comment:"how often roots past their expiry are deleted, 0 disables the reaper"`
+	BatchSize    int           `toml:"batch_size" comment:"expired roots deleted per transaction"`
+	ArchiveDir   string        `toml:"archive_dir" comment:"write expired roots no namespace serves anymore to a car file in this directory as they are deleted, empty disables"`
+	PurgeDelay   time.Duration `toml:"purge_delay" comment:"how long deleted roots can be undeleted before the reaper removes them"`
+}
+
+type Quota struct {
+	Tenant   string `toml:"tenant"`
+	MaxRoots int64  `toml:"max_roots"`
+	MaxBytes int64  `toml:"max_bytes"`
+}
+
+type Quotas struct {
+	MaxRoots int64   `toml:"max_roots" comment:"live roots each tenant may store, 0 is unlimited"`
+	MaxBytes int64   `toml:"max_bytes" comment:"bytes of live roots each tenant may store, 0 is unlimited"`
+	Tenants  []Quota `toml:"tenants" comment:"quotas replacing the defaults for a tenant, tenants are token identities"`
+}
+
+type Profiling struct {
+	BlockProfileRate     int `toml:"block_profile_rate" comment:"sample one blocking event per this many nanoseconds blocked, 0 disables"`
+	MutexProfileFraction int `toml:"mutex_profile_fraction" comment:"sample one in this many mutex contention events, 0 disables"`
+}
+
+// Server is the configuration of retrieve-server run.
+type Server struct {
+	Listen        string        `toml:"listen" comment:"address of the public block api"`
+	AdminListen   string        `toml:"admin_listen" comment:"address for pprof, metrics, health probes and admin endpoints, which are not served on listen so metrics scrapes must target this address; empty serves them on listen, where the admin endpoints need auth tokens"`
+	DrainDelay    time.Duration `toml:"drain_delay" comment:"how long shutdown keeps serving with readiness failing, so load balancers stop routing first"`
+	ShutdownGrace time.Duration `toml:"shutdown_grace" comment:"how long shutdown waits for requests in flight before aborting them"`
+
+	Log       Log       `toml:"log"`
+	DB        DB        `toml:"db"`
+	TLS       TLS       `toml:"tls"`
+	Limits    Limits    `toml:"limits"`
+	Uploads   Uploads   `toml:"uploads"`
+	Retention Retention `toml:"retention"`
+	Quotas    Quotas    `toml:"quotas"`
+	AccessLog AccessLog `toml:"access_log"`
+	Tracing   Tracing   `toml:"tracing"`
+	Auth      Auth      `toml:"auth"`
+	Profiling Profiling `toml:"profiling"`
+}
+
+type Backend struct {
+	Addr    string        `toml:"addr" comment:"retrieve server host:port, or a url such as https://host:port"`
+	Token   string        `toml:"token" comment:"bearer token sent to the retrieve server"`
+	Timeout time.Duration `toml:"timeout" comment:"timeout of a single request to the retrieve server, 0 disables"`
+
+	TLS ClientTLS `toml:"tls"`
+}
+
+type Cache struct {
+	Size int64         `toml:"size" comment:"bytes of blocks cached in memory, 0 disables the cache"`
+	TTL  time.Duration `toml:"ttl" comment:"how long a cached block is served, deleted or expired roots are served from the cache until then; 0 keeps blocks until they are evicted"`
+}
+
+// HTTP is the configuration of retrieve-http run.
+type HTTP struct {
+	Listen        string        `toml:"listen" comment:"address of the public gateway"`
+	AdminListen   string        `toml:"admin_listen" comment:"address for pprof, metrics, health probes and admin endpoints, which are not served on listen so metrics scrapes must target this address; empty serves them on listen, where the admin endpoints need auth tokens"`
+	DrainDelay    time.Duration `toml:"drain_delay" comment:"how long shutdown keeps serving with readiness failing, so load balancers stop routing first"`
+	ShutdownGrace time.Duration `toml:"shutdown_grace" comment:"how long shutdown waits for requests in flight before aborting them"`
+	Namespaces    []string      `toml:"namespaces" comment:"retrieve server namespaces served, blocks are looked up in order; empty serves the default namespace"`
+
+	Log       Log       `toml:"log"`
+	Backend   Backend   `toml:"backend"`
+	Cache     Cache     `toml:"cache"`
+	TLS       TLS       `toml:"tls"`
+	Limits    Limits    `toml:"limits"`
+	AccessLog AccessLog `toml:"access_log"`
+	Tracing   Tracing   `toml:"tracing"`
+	Auth      Auth      `toml:"auth"`
+}
+
+func defaultLimits() Limits {
+	return Limits{
+		Burst:        20,
+		MaxQueue:     100,
+		QueueTimeout: 5 * time.Second,
+	}
+}
+
+func defaultAccessLog() AccessLog {
+	return AccessLog{
+		Output:     "stdout",
+		SampleRate: 1,
+		MaxSizeMB:  100,
+		MaxBackups: 10,
+		MaxAgeDays: 30,
+	}
+}
+
+func defaultTracing() Tracing {
+	return Tracing{
+		Endpoint:    "localhost:4318",
+		SampleRatio: 1,
+	}
+}
+
+func DefaultServer() *Server {
+	return &Server{
+		Listen:        "0.0.0.0:9876",
+		AdminListen:   "127.0.0.1:9877",
+		DrainDelay:    5 * time.Second,
+		ShutdownGrace: 30 * time.Second,
+		Log: Log{
+			Level: "info",
+		},
+		DB: DB{
+			Path:        "./rserver.db",
+			AutoMigrate: true,
+		},
+		Limits: defaultLimits(),
+		Uploads: Uploads{
+			MaxBlockSize: 4 << 20,
+			MaxBodySize:  8 << 20,
+			MaxCarSize:   128 << 20,
+		},
+		Retention: Retention{
+			ReapInterval: 10 * time.Minute,
+			BatchSize:    1000,
+			PurgeDelay:   7 * 24 * time.Hour,
+		},
+		AccessLog: defaultAccessLog(),
+		Tracing:   defaultTracing(),
+	}
+}
+
+func DefaultHTTP() *HTTP {
+	return &HTTP{
+		Listen:        "0.0.0.0:9875",
+		AdminListen:   "127.0.0.1:9874",
+		DrainDelay:    5 * time.Second,
+		ShutdownGrace: 30 * time.Second,
+		Log: Log{
+			Level: "info",
+		},
+		Backend: Backend{
+			Addr:    "127.0.0.1:9876",
+			Timeout: 30 * time.Second,
+		},
+		Cache: Cache{
+			Size: 256 << 20,
+			TTL:  time.Minute,
+		},
+		Limits:    defaultLimits(),
+		AccessLog: defaultAccessLog(),
+		Tracing:   defaultTracing(),
+	}
+}
+
+// Load decodes the toml file at path over cfg, then applies the environment
+// variables named prefix_SECTION_KEY, e.g. RSERVER_DB_PATH.
+func Load(path string, prefix string, cfg any) error {
+	if path != "" {
+		md, err := toml.DecodeFile(path, cfg)
+		if err != nil {
+			return fmt.Errorf("decode config %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("unknown config keys in %s: %v", path, undecoded)
+		}
+	}
+
+	return applyEnv(prefix, cfg, os.LookupEnv)
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// keys whose values are never logged
+var secretKeys = map[string]bool{
+	"token":  true,
+	"tokens": true,
+}
+
+type Change struct {
+	Key string
+	Old any
+	New any
+}
+
+// Diff returns the settings that differ between two configs of the same
+// type, keys are the dotted toml paths such as limits.rate.
+func Diff(old, new any) []Change {
+	return diffSection("", reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem())
+}
+
+func diffSection(section string, old, new reflect.Value) []Change {
+	var changes []Change
+
+	t := old.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := tomlKey(f)
+		if section != "" {
+			key = section + "." + key
+		}
+
+		ov, nv := old.Field(i), new.Field(i)
+		if f.Type.Kind() == reflect.Struct && f.Type != durationType {
+			changes = append(changes, diffSection(key, ov, nv)...)
+			continue
+		}
+
+		if reflect.DeepEqual(ov.Interface(), nv.Interface()) {
+			continue
+		}
+
+		c := Change{Key: key, Old: ov.Interface(), New: nv.Interface()}
+		if secretKeys[tomlKey(f)] {
+			c.Old, c.New = redact(ov), redact(nv)
+		}
+		changes = append(changes, c)
+	}
+
+	return changes
+}
+
+func redact(v reflect.Value) string {
+	if v.Kind() == reflect.Slice {
+		return fmt.Sprintf("[%d redacted]", v.Len())
+	}
+	if v.IsZero() {
+		return ""
+	}
+	return "redacted"
+}
+
+// HasPrefix reports whether the change is to key or a setting below it.
+func (c Change) HasPrefix(key string) bool {
+	return c.Key == key || strings.HasPrefix(c.Key, key+".")
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// ApplyFlags overrides config fields with the flags set on the command
+// line, targets maps flag names to pointers into the config.
+func ApplyFlags(cctx *cli.Context, targets map[string]any) error {
+	for name, target := range targets {
+		if !cctx.IsSet(name) {
+			continue
+		}
+
+		switch p := target.(type) {
+		case *string:
+			*p = cctx.String(name)
+		case *bool:
+			*p = cctx.Bool(name)
+		case *int:
+			*p = cctx.Int(name)
+		case *int64:
+			*p = cctx.Int64(name)
+		case *float64:
+			*p = cctx.Float64(name)
+		case *time.Duration:
+			*p = cctx.Duration(name)
+		case *[]string:
+			*p = cctx.StringSlice(name)
+		default:
+			return fmt.Errorf("flag %s: unsupported config type %T", name, target)
+		}
+	}
+
+	return nil
+}
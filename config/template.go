@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteTemplate writes cfg as toml with every key commented out and
+// annotated, so the output of `config default` documents all settings.
+func WriteTemplate(w io.Writer, cfg any) error {
+	return writeSection(w, "", reflect.ValueOf(cfg).Elem())
+}
+
+func writeSection(w io.Writer, section string, v reflect.Value) error {
+	t := v.Type()
+
+	// keys have to come before the sub tables in toml
+	var tables []int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fv := v.Field(i)
+
+		if f.Type.Kind() == reflect.Struct && f.Type != durationType {
+			tables = append(tables, i)
+			continue
+		}
+
+		if c := f.Tag.Get("comment"); c != "" {
+			fmt.Fprintf(w, "# %s\n", c)
+		}
+
+		if f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct {
+			name := tomlKey(f)
+			if section != "" {
+				name = section + "." + name
+			}
+			writeTableExample(w, name, f.Type.Elem())
+			continue
+		}
+
+		fmt.Fprintf(w, "#%s = %s\n", tomlKey(f), formatValue(fv))
+	}
+
+	for _, i := range tables {
+		name := tomlKey(t.Field(i))
+		if section != "" {
+			name = section + "." + name
+		}
+
+		fmt.Fprintf(w, "\n[%s]\n", name)
+		if err := writeSection(w, name, v.Field(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeTableExample writes a commented out entry of a list of tables.
+func writeTableExample(w io.Writer, name string, t reflect.Type) {
+	fmt.Fprintf(w, "#[[%s]]\n", name)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fmt.Fprintf(w, "#%s = %s\n", tomlKey(f), formatValue(reflect.Zero(f.Type)))
+	}
+}
+
+func formatValue(v reflect.Value) string {
+	if v.Type() == durationType {
+		return strconv.Quote(time.Duration(v.Int()).String())
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return strconv.Quote(v.String())
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	case reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = formatValue(v.Index(i))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case reflect.Map:
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+
+		items := make([]string, len(keys))
+		for i, k := range keys {
+			items[i] = fmt.Sprintf("%s = %s", k, formatValue(v.MapIndex(reflect.ValueOf(k))))
+		}
+		return "{" + strings.Join(items, ", ") + "}"
+	}
+
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlockStore keeps the root blocks of a db outside its sql tables, the sql
+// db stays the record of metadata, deleted roots and the audit log.
+type BlockStore interface {
+	// Block returns the block of root if ns serves it, missing roots are
+	// reported as sql.ErrNoRows like the sql db does.
+	Block(ns, root string) ([]byte, error)
+	// Size returns the block size of root if ns serves it.
+	Size(ns, root string) (int, error)
+	// Raw returns the block of root whether or not a namespace serves it.
+	Raw(root string) ([]byte, error)
+	// Batch collects the changes of one sql transaction.
+	Batch() BlockBatch
+	// Backup writes a copy of the store to the new directory dir while it
+	// keeps serving.
+	Backup(dir string) error
+	Close() error
+}
+
+// BlockBatch collects the block changes of one sql transaction, Commit
+// writes them once the transaction committed.
+type BlockBatch interface {
+	// Put stores the block of root and serves it in ns.
+	Put(ns, root string, block []byte) error
+	// Show serves the stored block of root in ns again.
+	Show(ns, root string) error
+	// Hide stops serving root in ns, or in every namespace when ns is empty.
+	Hide(ns, root string) error
+	// Remove deletes the block of root and stops serving it.
+	Remove(root string) error
+	Commit() error
+	Close()
+}
+
+// Batch returns a batch of the block store, one doing nothing when the sql
+// db keeps the blocks.
+func (d *DB) Batch() BlockBatch {
+	if d.Blocks == nil {
+		return nopBatch{}
+	}
+	return d.Blocks.Batch()
+}
+
+type nopBatch struct{}
+
+func (nopBatch) Put(string, string, []byte) error { return nil }
+func (nopBatch) Show(string, string) error        { return nil }
+func (nopBatch) Hide(string, string) error        { return nil }
+func (nopBatch) Remove(string) error              { return nil }
+func (nopBatch) Commit() error                    { return nil }
+func (nopBatch) Close()                           {}
+
+// openBlockStore opens the sqlite metadata db dir/meta.db and the block
+// store under dir/blocks of a pebble:// or flatfs:// path, options are
+// given as url query parameters.
+func openBlockStore(dbPath string) (*sql.DB, BlockStore, error) {
+	u, err := url.Parse(dbPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Host != "" || u.Path == "" {
+		return nil, nil, fmt.Errorf("%s path needs an absolute directory: %s", u.Scheme, dbPath)
+	}
+	dir := u.Path
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "meta.db"))
+	if err != nil {
+		return nil, nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	var blocks BlockStore
+	switch u.Scheme {
+	case "pebble":
+		blocks, err = openPebble(filepath.Join(dir, "blocks"))
+	case "flatfs":
+		blocks, err = openFlatfs(filepath.Join(dir, "blocks"), db, u.Query())
+	default:
+		err = fmt.Errorf("unknown block store: %s", u.Scheme)
+	}
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return db, blocks, nil
+}
+
+// isBlockStorePath reports whether dbPath selects a block store.
+func isBlockStorePath(dbPath string) bool {
+	return strings.HasPrefix(dbPath, "pebble://") || strings.HasPrefix(dbPath, "flatfs://")
+}
@@ -1,13 +1,19 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/gh-efforts/retrieve-server/metrics"
 	logging "github.com/ipfs/go-log/v2"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
 )
 
 var log = logging.Logger("db")
@@ -15,30 +21,95 @@ var log = logging.Logger("db")
 type DB struct {
 	DB     *sql.DB
 	DBType string
+
+	// Blocks holds the root blocks of a pebble:// or flatfs:// db, it is
+	// nil for the other backends which keep blocks in the sql db.
+	Blocks BlockStore
+}
+
+// Options configures the postgres connection pool, sqlite always uses a
+// single connection.
+type Options struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// AutoMigrate applies pending schema migrations when the db is opened,
+	// otherwise OpenDB fails until they are applied with Migrate.
+	AutoMigrate bool
+}
+
+// OpenDB opens the db and makes sure its schema is the one this release
+// runs against.
+func OpenDB(dbPath string, opts Options) (*DB, error) {
+	d, err := Open(dbPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := d.prepare(opts); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// OpenPostgres opens a postgres or yugabyte db like OpenDB, whatever the
+// form of dsn, a key=value dsn would be taken for a sqlite path by OpenDB.
+func OpenPostgres(dsn string, opts Options) (*DB, error) {
+	db, err := openPostgres(dsn, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("db ping: %w", err)
+	}
+
+	d := &DB{DB: db, DBType: "postgres"}
+	if err := d.prepare(opts); err != nil {
+		d.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// prepare applies pending migrations when asked to and checks the schema
+// version.
+func (d *DB) prepare(opts Options) error {
+	ctx := context.Background()
+	if opts.AutoMigrate {
+		if _, err := d.Migrate(ctx); err != nil {
+			return err
+		}
+	}
+
+	return d.checkVersion(ctx)
 }
 
-func OpenDB(dbPath string) (*DB, error) {
+// Open connects to the db without touching its schema.
+func Open(dbPath string, opts Options) (*DB, error) {
 	var db *sql.DB
 	var err error
-	var createDBSQL string
 	var dbType string
+	var blocks BlockStore
 
 	if strings.HasPrefix(dbPath, "postgres") || strings.HasPrefix(dbPath, "yugabyte") {
-		log.Debugf("open postgres db: %s", dbPath)
-		db, err = sql.Open("postgres", dbPath)
+		db, err = openPostgres(dbPath, opts)
 		if err != nil {
 			return nil, err
 		}
-		//db.SetMaxOpenConns(10)
-
-		createDBSQL = `
-        CREATE TABLE IF NOT EXISTS RootBlocks (
-            root TEXT NOT NULL,
-            size INTEGER NOT NULL,
-            block BYTEA NOT NULL,
-            PRIMARY KEY (root)
-        );`
+
 		dbType = "postgres"
+	} else if isBlockStorePath(dbPath) {
+		log.Debugf("open block store db: %s", dbPath)
+		db, blocks, err = openBlockStore(dbPath)
+		if err != nil {
+			return nil, err
+		}
+
+		dbType = "sqlite"
 	} else {
 		log.Debugf("open sqlite db: %s", dbPath)
 		db, err = sql.Open("sqlite3", "file:"+dbPath)
@@ -47,53 +118,184 @@ func OpenDB(dbPath string) (*DB, error) {
 		}
 		db.SetMaxOpenConns(1)
 
-		createDBSQL = `
-		CREATE TABLE IF NOT EXISTS RootBlocks (
-			root TEXT NOT NULL PRIMARY KEY,
-			size INT NOT NULL,
-			block BLOB NOT NULL
-		);`
 		dbType = "sqlite"
 	}
 
 	if err = db.Ping(); err != nil {
+		db.Close()
+		if blocks != nil {
+			blocks.Close()
+		}
 		return nil, fmt.Errorf("db ping: %w", err)
 	}
 
-	if _, err := db.Exec(createDBSQL); err != nil {
-		return nil, fmt.Errorf("failed to create tables in DB: %w", err)
+	return &DB{DB: db, DBType: dbType, Blocks: blocks}, nil
+}
+
+func openPostgres(dsn string, opts Options) (*sql.DB, error) {
+	log.Debugf("open postgres db: %s", dsn)
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+
+	return db, nil
+}
+
+// Close closes the sql db and the block store.
+func (d *DB) Close() error {
+	err := d.DB.Close()
+	if d.Blocks != nil {
+		err = errors.Join(err, d.Blocks.Close())
+	}
+	return err
+}
+
+// Timer starts timing a query, calling the returned function records its
+// duration tagged with op and the db backend.
+func (d *DB) Timer(op string) func() time.Duration {
+	ctx, _ := tag.New(context.Background(),
+		tag.Upsert(metrics.Operation, op),
+		tag.Upsert(metrics.Backend, d.DBType),
+	)
+	return metrics.Timer(ctx, metrics.DBQueryDuration)
+}
+
+// RecordStats records the connection pool gauges every interval until ctx is done.
+func (d *DB) RecordStats(ctx context.Context, interval time.Duration) {
+	tctx, _ := tag.New(context.Background(), tag.Upsert(metrics.Backend, d.DBType))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		st := d.DB.Stats()
+		stats.Record(tctx,
+			metrics.DBOpenConnections.M(int64(st.OpenConnections)),
+			metrics.DBInUseConnections.M(int64(st.InUse)),
+			metrics.DBIdleConnections.M(int64(st.Idle)),
+			metrics.DBWaitCount.M(st.WaitCount),
+			metrics.DBWaitDuration.M(float64(st.WaitDuration.Nanoseconds())/1e6),
+		)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *DB) Ping(ctx context.Context) error {
+	return d.DB.PingContext(ctx)
+}
+
+// CheckSchema reports an error when the schema is not the version this
+// release runs against, e.g. after another release migrated the db.
+func (d *DB) CheckSchema(ctx context.Context) error {
+	version, err := schemaVersion(ctx, d.DB)
+	if err != nil {
+		return fmt.Errorf("schema_version: %w", err)
+	}
+	if version != SchemaLatest() {
+		return fmt.Errorf("schema version %d, want %d", version, SchemaLatest())
 	}
 
-	return &DB{DB: db, DBType: dbType}, nil
+	return nil
 }
 
 // MergeSQLiteToYugabyte 从SQLite合并数据到YugabyteDB
+// SQLite先升级到当前schema, 命名空间, 过期时间, 交易, 删除标记和审计日志一并合并.
+// pebble://和flatfs://的块从块存储读取. YugabyteDB中已有的记录保持不变
 func MergeSQLiteToYugabyte(sqlitePath, yugabyteDSN string) error {
 	log.Infof("merge sqlite to yugabyte: %s, %s", sqlitePath, yugabyteDSN)
 
-	// 打开SQLite数据库
-	sqliteDB, err := sql.Open("sqlite3", sqlitePath)
+	// 打开SQLite数据库, 并升级到当前schema
+	sd, err := OpenDB(sqlitePath, Options{AutoMigrate: true})
 	if err != nil {
 		return fmt.Errorf("打开SQLite数据库失败: %w", err)
 	}
-	defer sqliteDB.Close()
+	defer sd.Close()
+	if sd.DBType != "sqlite" {
+		return fmt.Errorf("%s 不是SQLite数据库", sqlitePath)
+	}
 
-	// 连接YugabyteDB
-	yugabyteDB, err := sql.Open("postgres", yugabyteDSN)
+	// 连接YugabyteDB, 并升级到当前schema
+	yd, err := OpenPostgres(yugabyteDSN, Options{AutoMigrate: true})
 	if err != nil {
 		return fmt.Errorf("连接YugabyteDB失败: %w", err)
 	}
-	defer yugabyteDB.Close()
+	defer yd.Close()
+
+	if err := mergeRootBlocks(sd, yd.DB); err != nil {
+		return err
+	}
+
+	err = mergeRows(sd.DB, yd.DB, "NamespaceRoots",
+		"SELECT ns, root, created_at, uploader, deleted_at, expires_at FROM NamespaceRoots",
+		`INSERT INTO NamespaceRoots(ns, root, created_at, uploader, deleted_at, expires_at) VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING`,
+		func(rows *sql.Rows) ([]any, error) {
+			var ns, root, uploader string
+			var created, deleted, expires sql.NullTime
+			err := rows.Scan(&ns, &root, &created, &uploader, &deleted, &expires)
+			return []any{ns, root, created, uploader, deleted, expires}, err
+		})
+	if err != nil {
+		return err
+	}
+
+	err = mergeRows(sd.DB, yd.DB, "RootDeals",
+		"SELECT root, piece_cid, deal_id, provider, sector, piece_offset FROM RootDeals",
+		`INSERT INTO RootDeals(root, piece_cid, deal_id, provider, sector, piece_offset) VALUES($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING`,
+		func(rows *sql.Rows) ([]any, error) {
+			var root, pieceCid, provider string
+			var dealID, sector, offset sql.NullInt64
+			err := rows.Scan(&root, &pieceCid, &dealID, &provider, &sector, &offset)
+			return []any{root, pieceCid, dealID, provider, sector, offset}, err
+		})
+	if err != nil {
+		return err
+	}
+
+	// 审计日志没有唯一键, 已合并过的记录跳过
+	err = mergeRows(sd.DB, yd.DB, "AuditLog",
+		"SELECT at, action, ns, root, actor, detail FROM AuditLog ORDER BY id",
+		`INSERT INTO AuditLog(at, action, ns, root, actor, detail) SELECT $1, $2, $3, $4, $5, $6
+		WHERE NOT EXISTS (SELECT 1 FROM AuditLog WHERE at = $1 AND action = $2 AND ns = $3 AND root = $4)`,
+		func(rows *sql.Rows) ([]any, error) {
+			var at time.Time
+			var action, ns, root, actor, detail string
+			err := rows.Scan(&at, &action, &ns, &root, &actor, &detail)
+			return []any{at.UTC(), action, ns, root, actor, detail}, err
+		})
+	if err != nil {
+		return err
+	}
+
+	log.Info("merge sqlite to yugabyte success")
+
+	return nil
+}
 
+// mergeRootBlocks 合并块, 已有的root保留YugabyteDB中的元数据和删除标记
+func mergeRootBlocks(sd *DB, yugabyteDB *sql.DB) error {
 	// 从SQLite读取数据
-	rows, err := sqliteDB.Query("SELECT root, size, block FROM RootBlocks")
+	rows, err := sd.DB.Query("SELECT root, size, block, created_at, uploader, codec, multihash, deleted_at, deleted_by FROM RootBlocks")
 	if err != nil {
 		return fmt.Errorf("查询SQLite数据失败: %w", err)
 	}
 	defer rows.Close()
 
 	// 准备YugabyteDB插入语句
-	stmt, err := yugabyteDB.Prepare("INSERT INTO RootBlocks(root, size, block) VALUES($1, $2, $3) ON CONFLICT (root) DO UPDATE SET size = $2, block = $3")
+	stmt, err := yugabyteDB.Prepare(`INSERT INTO RootBlocks(root, size, block, created_at, updated_at, uploader, source, codec, multihash, deleted_at, deleted_by)
+		VALUES($1, $2, $3, $4, $5, $6, 'migrate', $7, $8, $9, $10)
+		ON CONFLICT (root) DO UPDATE SET size = $2, block = $3, updated_at = $5`)
 	if err != nil {
 		return fmt.Errorf("准备YugabyteDB插入语句失败: %w", err)
 	}
@@ -101,22 +303,69 @@ func MergeSQLiteToYugabyte(sqlitePath, yugabyteDSN string) error {
 
 	// 遍历SQLite数据并插入到YugabyteDB
 	for rows.Next() {
-		var root string
+		var root, uploader, codec, mh, deletedBy string
 		var size int
 		var block []byte
-		if err := rows.Scan(&root, &size, &block); err != nil {
+		var created, deleted sql.NullTime
+		if err := rows.Scan(&root, &size, &block, &created, &uploader, &codec, &mh, &deleted, &deletedBy); err != nil {
 			return fmt.Errorf("扫描SQLite行失败: %w", err)
 		}
 
-		_, err = stmt.Exec(root, size, block)
+		// 块存储的块不在SQLite中
+		if sd.Blocks != nil {
+			block, err = sd.Blocks.Raw(root)
+			if err != nil {
+				return fmt.Errorf("读取块 %s 失败: %w", root, err)
+			}
+		}
+
+		now := time.Now().UTC()
+		if !created.Valid {
+			created.Time = now
+		}
+		_, err = stmt.Exec(root, size, block, created.Time.UTC(), now, uploader, codec, mh, deleted, deletedBy)
 		if err != nil {
 			return fmt.Errorf("插入数据到YugabyteDB失败: %w", err)
 		}
 
 		log.Debugf("insert data to yugabyte: %s, %d", root, size)
 	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("查询SQLite数据失败: %w", err)
+	}
 
-	log.Info("merge sqlite to yugabyte success")
+	return nil
+}
+
+// mergeRows 把SQLite表的每一行插入到YugabyteDB, scan返回插入语句的参数
+func mergeRows(sqliteDB, yugabyteDB *sql.DB, table, query, insert string, scan func(*sql.Rows) ([]any, error)) error {
+	rows, err := sqliteDB.Query(query)
+	if err != nil {
+		return fmt.Errorf("查询SQLite %s 失败: %w", table, err)
+	}
+	defer rows.Close()
+
+	stmt, err := yugabyteDB.Prepare(insert)
+	if err != nil {
+		return fmt.Errorf("准备YugabyteDB %s 插入语句失败: %w", table, err)
+	}
+	defer stmt.Close()
+
+	n := 0
+	for rows.Next() {
+		args, err := scan(rows)
+		if err != nil {
+			return fmt.Errorf("扫描SQLite %s 行失败: %w", table, err)
+		}
+		if _, err := stmt.Exec(args...); err != nil {
+			return fmt.Errorf("插入 %s 到YugabyteDB失败: %w", table, err)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("查询SQLite %s 失败: %w", table, err)
+	}
 
+	log.Infof("merged %d rows of %s", n, table)
 	return nil
 }
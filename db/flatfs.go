@@ -0,0 +1,299 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	defaultShardWidth = 2
+	shardingFile      = "SHARDING"
+	tmpDir            = ".tmp"
+)
+
+var digestEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// flatfsLive selects the size of a root served by a namespace, the sql
+// tables are the index of a flatfs store so sizes never touch the files.
+const flatfsLive = `SELECT b.size FROM RootBlocks b JOIN NamespaceRoots n ON n.root = b.root
+	WHERE n.ns=$1 AND n.root=$2 AND n.deleted_at IS NULL AND b.deleted_at IS NULL`
+
+// flatfsStore keeps every root block in a file dir/<shard>/<root>.data,
+// shard being the first characters of the base32 multihash digest, so the
+// blocks can be copied, snapshotted and inspected with standard tools.
+// Blocks are written to dir/.tmp and renamed into place, with sync set the
+// files and their directories are fsynced first.
+type flatfsStore struct {
+	dir   string
+	db    *sql.DB
+	width int
+	sync  bool
+}
+
+// openFlatfs opens the store in dir, the shard query parameter sets the
+// shard width of a new store and sync=false skips the fsyncs.
+func openFlatfs(dir string, db *sql.DB, opts url.Values) (*flatfsStore, error) {
+	s := &flatfsStore{dir: dir, db: db, sync: true}
+
+	if v := opts.Get("sync"); v != "" {
+		sync, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flatfs sync: %s", v)
+		}
+		s.sync = sync
+	}
+
+	width := 0
+	if v := opts.Get("shard"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 8 {
+			return nil, fmt.Errorf("invalid flatfs shard width: %s", v)
+		}
+		width = n
+	}
+	if err := s.loadSharding(width); err != nil {
+		return nil, err
+	}
+
+	// files of writes that did not finish
+	if err := os.RemoveAll(filepath.Join(dir, tmpDir)); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, tmpDir), 0o755); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loadSharding reads the shard width the store was created with, a store
+// cannot change it once blocks are stored.
+func (s *flatfsStore) loadSharding(width int) error {
+	path := filepath.Join(s.dir, shardingFile)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if width == 0 {
+			width = defaultShardWidth
+		}
+		if err := os.MkdirAll(s.dir, 0o755); err != nil {
+			return err
+		}
+		s.width = width
+		return os.WriteFile(path, []byte(strconv.Itoa(width)+"\n"), 0o644)
+	}
+	if err != nil {
+		return err
+	}
+
+	stored, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", path, err)
+	}
+	if width != 0 && width != stored {
+		return fmt.Errorf("flatfs store %s is sharded by %d characters, not %d", s.dir, stored, width)
+	}
+	s.width = stored
+	return nil
+}
+
+func (s *flatfsStore) Close() error {
+	return nil
+}
+
+func (s *flatfsStore) Block(ns, root string) ([]byte, error) {
+	if _, err := s.Size(ns, root); err != nil {
+		return nil, err
+	}
+
+	block, err := s.Raw(root)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("block file of %s missing", root)
+	}
+	return block, err
+}
+
+func (s *flatfsStore) Size(ns, root string) (int, error) {
+	var size int
+	err := s.db.QueryRow(flatfsLive, ns, root).Scan(&size)
+	return size, err
+}
+
+func (s *flatfsStore) Raw(root string) ([]byte, error) {
+	path, err := s.path(root)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, sql.ErrNoRows
+	}
+	return block, err
+}
+
+// path returns the file of root.
+func (s *flatfsStore) path(root string) (string, error) {
+	c, err := cid.Parse(root)
+	if err != nil {
+		return "", err
+	}
+	mh, err := multihash.Decode(c.Hash())
+	if err != nil {
+		return "", err
+	}
+
+	shard := strings.ToLower(digestEncoding.EncodeToString(mh.Digest))
+	shard = shard[:min(s.width, len(shard))]
+	return filepath.Join(s.dir, shard, c.String()+".data"), nil
+}
+
+// put writes block to path unless it is there already, the file name is
+// the root so the block cannot differ.
+func (s *flatfsStore) put(path string, block []byte) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	f, err := os.CreateTemp(filepath.Join(s.dir, tmpDir), "put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(block); err != nil {
+		f.Close()
+		return err
+	}
+	if s.sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	shardDir := filepath.Dir(path)
+	if err := os.MkdirAll(shardDir, 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	if s.sync {
+		return syncDir(shardDir)
+	}
+	return nil
+}
+
+// Backup hard links every block file into dir, copying them when dir is on
+// another file system. Block files never change once written.
+func (s *flatfsStore) Backup(dir string) error {
+	return filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel == tmpDir {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(filepath.Join(dir, rel), 0o755)
+		}
+
+		dst := filepath.Join(dir, rel)
+		if err := os.Link(path, dst); err == nil {
+			return nil
+		}
+		return copyFile(path, dst)
+	})
+}
+
+// Batch writes blocks as they are put, a transaction that fails leaves the
+// file of a root not stored which the next upload of it reuses. Removals
+// wait for the transaction to commit.
+func (s *flatfsStore) Batch() BlockBatch {
+	return &flatfsBatch{s: s}
+}
+
+type flatfsBatch struct {
+	s       *flatfsStore
+	removed []string
+}
+
+func (b *flatfsBatch) Put(ns, root string, block []byte) error {
+	path, err := b.s.path(root)
+	if err != nil {
+		return err
+	}
+	return b.s.put(path, block)
+}
+
+// Show and Hide have nothing to do, the sql index records which namespaces
+// serve a root.
+func (b *flatfsBatch) Show(ns, root string) error { return nil }
+func (b *flatfsBatch) Hide(ns, root string) error { return nil }
+
+func (b *flatfsBatch) Remove(root string) error {
+	path, err := b.s.path(root)
+	if err != nil {
+		return err
+	}
+	b.removed = append(b.removed, path)
+	return nil
+}
+
+func (b *flatfsBatch) Commit() error {
+	for _, path := range b.removed {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *flatfsBatch) Close() {}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,169 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testRoot = "bafkreicuomo7t35v3cllisvp6xmbgkjzelepxjuaio4jj6rghsahktpehu"
+
+func TestFlatfsOpen(t *testing.T) {
+	tests := []struct {
+		name string
+		// shard width the store was created with, 0 for a new store
+		stored  int
+		opts    string
+		want    int
+		wantErr string
+	}{
+		{name: "new store uses the default width", want: defaultShardWidth},
+		{name: "new store takes the shard option", opts: "shard=4", want: 4},
+		{name: "existing store keeps its width", stored: 3, want: 3},
+		{name: "existing store accepts its own width", stored: 3, opts: "shard=3", want: 3},
+		{name: "existing store cannot change width", stored: 3, opts: "shard=2", wantErr: "sharded by 3"},
+		{name: "shard width out of range", opts: "shard=9", wantErr: "invalid flatfs shard width"},
+		{name: "invalid sync", opts: "sync=maybe", wantErr: "invalid flatfs sync"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.stored != 0 {
+				if _, err := openFlatfs(dir, nil, url.Values{"shard": {strconv.Itoa(tt.stored)}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			opts, err := url.ParseQuery(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := openFlatfs(dir, nil, opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if s.width != tt.want {
+				t.Fatalf("width %d, want %d", s.width, tt.want)
+			}
+			path, err := s.path(testRoot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if shard := filepath.Base(filepath.Dir(path)); len(shard) != tt.want {
+				t.Fatalf("shard dir %s, want %d characters", shard, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlatfsBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		batches [][]blockOp
+		abort   bool
+		raw     bool
+	}{
+		{
+			name:    "put writes the block file",
+			batches: [][]blockOp{{{"put", "a", testRoot}}},
+			raw:     true,
+		},
+		{
+			name:    "put of a stored block keeps the file",
+			batches: [][]blockOp{{{"put", "a", testRoot}}, {{"put", "b", testRoot}}},
+			raw:     true,
+		},
+		{
+			name:    "hide keeps the file",
+			batches: [][]blockOp{{{"put", "a", testRoot}}, {{"hide", "", testRoot}}},
+			raw:     true,
+		},
+		{
+			name:    "remove deletes the file on commit",
+			batches: [][]blockOp{{{"put", "a", testRoot}}, {{"remove", "", testRoot}}},
+		},
+		{
+			name:    "uncommitted removals keep the file",
+			batches: [][]blockOp{{{"put", "a", testRoot}}, {{"remove", "", testRoot}}},
+			abort:   true,
+			raw:     true,
+		},
+		{
+			name:    "removing a missing file succeeds",
+			batches: [][]blockOp{{{"remove", "", testRoot}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := openFlatfs(dir, nil, url.Values{"sync": {"false"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, ops := range tt.batches {
+				commit := !tt.abort || i < len(tt.batches)-1
+				if err := applyBlockOps(t, s, ops, commit); err != nil {
+					t.Fatalf("batch %d: %v", i, err)
+				}
+			}
+
+			block, err := s.Raw(testRoot)
+			if tt.raw {
+				if err != nil || string(block) != "block of "+testRoot {
+					t.Fatalf("raw: %q %v", block, err)
+				}
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("raw: %v, want sql.ErrNoRows", err)
+			}
+
+			tmp, err := os.ReadDir(filepath.Join(dir, tmpDir))
+			if err != nil || len(tmp) != 0 {
+				t.Fatalf("%d files left in %s: %v", len(tmp), tmpDir, err)
+			}
+		})
+	}
+}
+
+func TestFlatfsBackup(t *testing.T) {
+	s, err := openFlatfs(t.TempDir(), nil, url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyBlockOps(t, s, []blockOp{{"put", "a", testRoot}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "backup")
+	if err := s.Backup(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, tmpDir)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("backup holds %s: %v", tmpDir, err)
+	}
+
+	b, err := openFlatfs(dir, nil, url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.width != s.width {
+		t.Fatalf("backup width %d, want %d", b.width, s.width)
+	}
+	if block, err := b.Raw(testRoot); err != nil || string(block) != "block of "+testRoot {
+		t.Fatalf("backup block: %q %v", block, err)
+	}
+}
@@ -0,0 +1,414 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrSchemaTooNew is returned when the db was migrated by a newer release,
+// running against it could corrupt data the newer schema relies on.
+var ErrSchemaTooNew = errors.New("db schema is newer than this release supports")
+
+// migration upgrades the schema to version, statements are per dialect.
+type migration struct {
+	version  int
+	name     string
+	sqlite   []string
+	postgres []string
+}
+
+// migrations are applied in order and must never be edited once released,
+// add a new version instead.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create RootBlocks",
+		sqlite: []string{`
+		CREATE TABLE IF NOT EXISTS RootBlocks (
+			root TEXT NOT NULL PRIMARY KEY,
+			size INT NOT NULL,
+			block BLOB NOT NULL
+		);`},
+		postgres: []string{`
+        CREATE TABLE IF NOT EXISTS RootBlocks (
+            root TEXT NOT NULL,
+            size INTEGER NOT NULL,
+            block BYTEA NOT NULL,
+            PRIMARY KEY (root)
+        );`},
+	},
+	{
+		// rows stored before this version have no timestamps and an empty
+		// uploader and source
+		version: 2,
+		name:    "add RootBlocks insertion metadata",
+		sqlite: []string{
+			`ALTER TABLE RootBlocks ADD COLUMN created_at TIMESTAMP`,
+			`ALTER TABLE RootBlocks ADD COLUMN updated_at TIMESTAMP`,
+			`ALTER TABLE RootBlocks ADD COLUMN uploader TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE RootBlocks ADD COLUMN source TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE RootBlocks ADD COLUMN codec TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE RootBlocks ADD COLUMN multihash TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX IF NOT EXISTS RootBlocks_created_at ON RootBlocks(created_at)`,
+		},
+		postgres: []string{
+			`ALTER TABLE RootBlocks ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ`,
+			`ALTER TABLE RootBlocks ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ`,
+			`ALTER TABLE RootBlocks ADD COLUMN IF NOT EXISTS uploader TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE RootBlocks ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE RootBlocks ADD COLUMN IF NOT EXISTS codec TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE RootBlocks ADD COLUMN IF NOT EXISTS multihash TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX IF NOT EXISTS RootBlocks_created_at ON RootBlocks(created_at)`,
+		},
+	},
+	{
+		version: 3,
+		name:    "create RootDeals",
+		sqlite: []string{`
+		CREATE TABLE IF NOT EXISTS RootDeals (
+			root TEXT NOT NULL,
+			piece_cid TEXT NOT NULL,
+			deal_id INTEGER,
+			provider TEXT NOT NULL DEFAULT '',
+			sector INTEGER,
+			piece_offset INTEGER,
+			PRIMARY KEY (root, piece_cid)
+		);`,
+			`CREATE INDEX IF NOT EXISTS RootDeals_piece_cid ON RootDeals(piece_cid)`,
+		},
+		postgres: []string{`
+        CREATE TABLE IF NOT EXISTS RootDeals (
+            root TEXT NOT NULL,
+            piece_cid TEXT NOT NULL,
+            deal_id BIGINT,
+            provider TEXT NOT NULL DEFAULT '',
+            sector BIGINT,
+            piece_offset BIGINT,
+            PRIMARY KEY (root, piece_cid)
+        );`,
+			`CREATE INDEX IF NOT EXISTS RootDeals_piece_cid ON RootDeals(piece_cid)`,
+		},
+	},
+	{
+		version: 4,
+		name:    "add RootBlocks expires_at",
+		sqlite: []string{
+			`ALTER TABLE RootBlocks ADD COLUMN expires_at TIMESTAMP`,
+			`CREATE INDEX IF NOT EXISTS RootBlocks_expires_at ON RootBlocks(expires_at)`,
+		},
+		postgres: []string{
+			`ALTER TABLE RootBlocks ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`,
+			`CREATE INDEX IF NOT EXISTS RootBlocks_expires_at ON RootBlocks(expires_at)`,
+		},
+	},
+	{
+		version: 5,
+		name:    "add RootBlocks tombstones and AuditLog",
+		sqlite: []string{
+			`ALTER TABLE RootBlocks ADD COLUMN deleted_at TIMESTAMP`,
+			`ALTER TABLE RootBlocks ADD COLUMN deleted_by TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX IF NOT EXISTS RootBlocks_deleted_at ON RootBlocks(deleted_at)`,
+			`
+		CREATE TABLE IF NOT EXISTS AuditLog (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			at TIMESTAMP NOT NULL,
+			action TEXT NOT NULL,
+			root TEXT NOT NULL,
+			actor TEXT NOT NULL DEFAULT '',
+			detail TEXT NOT NULL DEFAULT ''
+		);`,
+			`CREATE INDEX IF NOT EXISTS AuditLog_root_at ON AuditLog(root, at)`,
+			`CREATE INDEX IF NOT EXISTS AuditLog_at ON AuditLog(at)`,
+		},
+		postgres: []string{
+			`ALTER TABLE RootBlocks ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+			`ALTER TABLE RootBlocks ADD COLUMN IF NOT EXISTS deleted_by TEXT NOT NULL DEFAULT ''`,
+			`CREATE INDEX IF NOT EXISTS RootBlocks_deleted_at ON RootBlocks(deleted_at)`,
+			`
+        CREATE TABLE IF NOT EXISTS AuditLog (
+            id BIGSERIAL PRIMARY KEY,
+            at TIMESTAMPTZ NOT NULL,
+            action TEXT NOT NULL,
+            root TEXT NOT NULL,
+            actor TEXT NOT NULL DEFAULT '',
+            detail TEXT NOT NULL DEFAULT ''
+        );`,
+			`CREATE INDEX IF NOT EXISTS AuditLog_root_at ON AuditLog(root, at)`,
+			`CREATE INDEX IF NOT EXISTS AuditLog_at ON AuditLog(at)`,
+		},
+	},
+	{
+		// quota checks of a tenant lock its TenantLocks row on postgres and
+		// yugabyte
+		version: 6,
+		name:    "index RootBlocks uploader and create TenantLocks",
+		sqlite: []string{
+			`CREATE INDEX IF NOT EXISTS RootBlocks_uploader ON RootBlocks(uploader)`,
+			`CREATE TABLE IF NOT EXISTS TenantLocks (tenant TEXT NOT NULL PRIMARY KEY)`,
+		},
+		postgres: []string{
+			`CREATE INDEX IF NOT EXISTS RootBlocks_uploader ON RootBlocks(uploader)`,
+			`CREATE TABLE IF NOT EXISTS TenantLocks (tenant TEXT NOT NULL PRIMARY KEY)`,
+		},
+	},
+	{
+		// existing roots move to the default namespace of the server
+		version: 7,
+		name:    "create NamespaceRoots",
+		sqlite: []string{
+			`
+		CREATE TABLE IF NOT EXISTS NamespaceRoots (
+			ns TEXT NOT NULL,
+			root TEXT NOT NULL,
+			created_at TIMESTAMP,
+			uploader TEXT NOT NULL DEFAULT '',
+			deleted_at TIMESTAMP,
+			PRIMARY KEY (ns, root)
+		);`,
+			`CREATE INDEX IF NOT EXISTS NamespaceRoots_root ON NamespaceRoots(root)`,
+			`INSERT INTO NamespaceRoots(ns, root, created_at, uploader, deleted_at)
+			SELECT 'default', root, created_at, uploader, deleted_at FROM RootBlocks`,
+			`ALTER TABLE AuditLog ADD COLUMN ns TEXT NOT NULL DEFAULT ''`,
+		},
+		postgres: []string{
+			`
+        CREATE TABLE IF NOT EXISTS NamespaceRoots (
+            ns TEXT NOT NULL,
+            root TEXT NOT NULL,
+            created_at TIMESTAMPTZ,
+            uploader TEXT NOT NULL DEFAULT '',
+            deleted_at TIMESTAMPTZ,
+            PRIMARY KEY (ns, root)
+        );`,
+			`CREATE INDEX IF NOT EXISTS NamespaceRoots_root ON NamespaceRoots(root)`,
+			`INSERT INTO NamespaceRoots(ns, root, created_at, uploader, deleted_at)
+			SELECT 'default', root, created_at, uploader, deleted_at FROM RootBlocks
+			ON CONFLICT DO NOTHING`,
+			`ALTER TABLE AuditLog ADD COLUMN IF NOT EXISTS ns TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		// a root expires from each namespace holding it on its own, the
+		// expiry of a root carries over to all of its namespaces
+		version: 8,
+		name:    "move expires_at to NamespaceRoots",
+		sqlite: []string{
+			`ALTER TABLE NamespaceRoots ADD COLUMN expires_at TIMESTAMP`,
+			`UPDATE NamespaceRoots SET expires_at = (SELECT expires_at FROM RootBlocks WHERE RootBlocks.root = NamespaceRoots.root)`,
+			`CREATE INDEX IF NOT EXISTS NamespaceRoots_expires_at ON NamespaceRoots(expires_at)`,
+			`DROP INDEX IF EXISTS RootBlocks_expires_at`,
+			`ALTER TABLE RootBlocks DROP COLUMN expires_at`,
+		},
+		postgres: []string{
+			`ALTER TABLE NamespaceRoots ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`,
+			`UPDATE NamespaceRoots n SET expires_at = b.expires_at FROM RootBlocks b WHERE b.root = n.root AND b.expires_at IS NOT NULL`,
+			`CREATE INDEX IF NOT EXISTS NamespaceRoots_expires_at ON NamespaceRoots(expires_at)`,
+			`ALTER TABLE RootBlocks DROP COLUMN IF EXISTS expires_at`,
+		},
+	},
+}
+
+// SchemaLatest is the schema version this release runs against.
+func SchemaLatest() int {
+	return migrations[len(migrations)-1].version
+}
+
+const createSchemaVersionSQL = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER NOT NULL PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`
+
+// arbitrary key of the postgres advisory lock serializing migrations of
+// servers started at the same time
+const migrateLockKey = 7_305_001
+
+// yugabyte has no advisory locks, migrations hold the row of schema_lock
+// instead
+const createSchemaLockSQL = `
+	CREATE TABLE IF NOT EXISTS schema_lock (
+		id INTEGER NOT NULL PRIMARY KEY
+	);`
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func schemaVersion(ctx context.Context, q querier) (int, error) {
+	var version sql.NullInt64
+	if err := q.QueryRowContext(ctx, `SELECT MAX(version) FROM schema_version`).Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 for
+// an empty db.
+func (d *DB) SchemaVersion(ctx context.Context) (int, error) {
+	if _, err := d.DB.ExecContext(ctx, createSchemaVersionSQL); err != nil {
+		return 0, fmt.Errorf("create schema_version: %w", err)
+	}
+
+	return schemaVersion(ctx, d.DB)
+}
+
+// Migrate applies the pending migrations, each in a transaction of its
+// own, and returns how many were applied. A failed migration leaves the
+// ones before it recorded, the next run picks up from there.
+func (d *DB) Migrate(ctx context.Context) (int, error) {
+	if _, err := d.DB.ExecContext(ctx, createSchemaVersionSQL); err != nil {
+		return 0, fmt.Errorf("create schema_version: %w", err)
+	}
+
+	// the lock holds a postgres connection of its own, the migrations need
+	// another one
+	if max := d.DB.Stats().MaxOpenConnections; d.DBType == "postgres" && max == 1 {
+		d.DB.SetMaxOpenConns(2)
+		defer d.DB.SetMaxOpenConns(max)
+	}
+
+	unlock, err := d.lockMigrations(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("lock migrations: %w", err)
+	}
+	defer unlock()
+
+	current, err := schemaVersion(ctx, d.DB)
+	if err != nil {
+		return 0, err
+	}
+	if current > SchemaLatest() {
+		return 0, fmt.Errorf("%w: db %d, supported %d", ErrSchemaTooNew, current, SchemaLatest())
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		if err := d.applyMigration(ctx, m); err != nil {
+			return applied, err
+		}
+
+		log.Infow("applied migration", "version", m.version, "name", m.name)
+		applied++
+	}
+
+	return applied, nil
+}
+
+func (d *DB) applyMigration(ctx context.Context, m migration) error {
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := m.sqlite
+	if d.DBType == "postgres" {
+		stmts = m.postgres
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migration %d %s: %w", m.version, m.name, err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_version(version, name) VALUES ($1, $2)`, m.version, m.name)
+	if err != nil {
+		return fmt.Errorf("record migration %d: %w", m.version, err)
+	}
+
+	return tx.Commit()
+}
+
+// lockMigrations serializes the migrations of servers started at the same
+// time. Postgres takes an advisory lock, yugabyte, which has none, locks the
+// row of schema_lock. Both hold a connection of their own until unlocked.
+// sqlite needs no lock, it runs a single connection and the migrations
+// themselves wait for the write lock of the file.
+func (d *DB) lockMigrations(ctx context.Context) (unlock func(), err error) {
+	if d.DBType != "postgres" {
+		return func() {}, nil
+	}
+
+	yugabyte, err := d.isYugabyte(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !yugabyte {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrateLockKey); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return func() {
+			if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrateLockKey); err != nil {
+				log.Warnw("unlock migrations", "err", err)
+			}
+			conn.Close()
+		}, nil
+	}
+
+	if _, err := conn.ExecContext(ctx, createSchemaLockSQL); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("create schema_lock: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, `INSERT INTO schema_lock(id) VALUES (1) ON CONFLICT DO NOTHING`); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT id FROM schema_lock WHERE id = 1 FOR UPDATE`); err != nil {
+		tx.Rollback()
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		tx.Rollback()
+		conn.Close()
+	}, nil
+}
+
+// isYugabyte tells yugabyte from postgres by its version string, e.g.
+// "PostgreSQL 11.2-YB-2.20.1.0-b0 on x86_64-pc-linux-gnu".
+func (d *DB) isYugabyte(ctx context.Context) (bool, error) {
+	var version string
+	if err := d.DB.QueryRowContext(ctx, `SELECT version()`).Scan(&version); err != nil {
+		return false, fmt.Errorf("db version: %w", err)
+	}
+	return strings.Contains(version, "-YB-"), nil
+}
+
+// checkVersion fails when the db needs migrations or was migrated by a
+// newer release.
+func (d *DB) checkVersion(ctx context.Context) error {
+	version, err := d.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case version > SchemaLatest():
+		return fmt.Errorf("%w: db %d, supported %d", ErrSchemaTooNew, version, SchemaLatest())
+	case version < SchemaLatest():
+		return fmt.Errorf("db schema %d is behind %d, run `retrieve-server db migrate`", version, SchemaLatest())
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Fatalf("migration %d %q has version %d", i, m.name, m.version)
+		}
+		if len(m.sqlite) == 0 || len(m.postgres) == 0 {
+			t.Fatalf("migration %d %q misses a dialect", m.version, m.name)
+		}
+	}
+}
+
+// migrateTo applies the migrations up to version the way Migrate does.
+func migrateTo(t *testing.T, d *DB, version int) {
+	t.Helper()
+
+	ctx := context.Background()
+	if _, err := d.DB.ExecContext(ctx, createSchemaVersionSQL); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations[:version] {
+		for _, stmt := range m.sqlite {
+			if _, err := d.DB.ExecContext(ctx, stmt); err != nil {
+				t.Fatalf("migration %d: %v", m.version, err)
+			}
+		}
+		if _, err := d.DB.ExecContext(ctx, `INSERT INTO schema_version(version, name) VALUES ($1, $2)`, m.version, m.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	const root = "bafkreicuomo7t35v3cllisvp6xmbgkjzelepxjuaio4jj6rghsahktpehu"
+
+	tests := []struct {
+		name string
+		// setup prepares the db before it is migrated
+		setup   func(t *testing.T, d *DB)
+		applied int
+		wantErr error
+		// namespaces holding root afterwards and how many of them with an
+		// expiry
+		namespaces int
+		expiring   int
+	}{
+		{
+			name:    "empty db",
+			setup:   func(t *testing.T, d *DB) {},
+			applied: SchemaLatest(),
+		},
+		{
+			name: "db of a release without schema_version",
+			setup: func(t *testing.T, d *DB) {
+				if _, err := d.DB.Exec(`CREATE TABLE RootBlocks (root TEXT NOT NULL PRIMARY KEY, size INT NOT NULL, block BLOB NOT NULL)`); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := d.DB.Exec(`INSERT INTO RootBlocks(root, size, block) VALUES ($1, 1, x'00')`, root); err != nil {
+					t.Fatal(err)
+				}
+			},
+			applied:    SchemaLatest(),
+			namespaces: 1,
+		},
+		{
+			name: "expiry of a root moves to its namespaces",
+			setup: func(t *testing.T, d *DB) {
+				migrateTo(t, d, 7)
+				if _, err := d.DB.Exec(`INSERT INTO RootBlocks(root, size, block, expires_at) VALUES ($1, 1, x'00', '2030-01-01 00:00:00+00:00')`, root); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := d.DB.Exec(`INSERT INTO NamespaceRoots(ns, root) VALUES ('default', $1), ('ns1', $1)`, root); err != nil {
+					t.Fatal(err)
+				}
+			},
+			applied:    SchemaLatest() - 7,
+			namespaces: 2,
+			expiring:   2,
+		},
+		{
+			name:    "migrated db",
+			setup:   func(t *testing.T, d *DB) { migrateTo(t, d, SchemaLatest()) },
+			applied: 0,
+		},
+		{
+			name: "db of a newer release",
+			setup: func(t *testing.T, d *DB) {
+				migrateTo(t, d, SchemaLatest())
+				if _, err := d.DB.Exec(`INSERT INTO schema_version(version, name) VALUES ($1, 'future')`, SchemaLatest()+1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrSchemaTooNew,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			path := filepath.Join(t.TempDir(), "test.db")
+
+			d, err := Open(path, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			tt.setup(t, d)
+
+			applied, err := d.Migrate(ctx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("migrate: %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if err := d.CheckSchema(ctx); err == nil {
+					t.Fatal("schema check passed")
+				}
+				return
+			}
+			if applied != tt.applied {
+				t.Fatalf("applied %d migrations, want %d", applied, tt.applied)
+			}
+			if err := d.CheckSchema(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			var n, expiring int
+			err = d.DB.QueryRow(`SELECT COUNT(*), COUNT(expires_at) FROM NamespaceRoots WHERE root=$1`, root).Scan(&n, &expiring)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.namespaces || expiring != tt.expiring {
+				t.Fatalf("%d namespaces hold the root, %d with an expiry, want %d and %d", n, expiring, tt.namespaces, tt.expiring)
+			}
+		})
+	}
+}
+
+// TestMigrateResume runs the migrations without the lock, as sqlite does,
+// and checks a failed one keeps those before it and is retried next time.
+func TestMigrateResume(t *testing.T) {
+	ctx := context.Background()
+
+	d, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	migrateTo(t, d, 5)
+	// migration 7 fails to index the root of this table
+	if _, err := d.DB.Exec(`CREATE TABLE NamespaceRoots (ns TEXT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T)
+		applied int
+		wantErr bool
+		version int
+	}{
+		{name: "failed migration", setup: func(t *testing.T) {}, applied: 1, wantErr: true, version: 6},
+		{
+			name: "retry",
+			setup: func(t *testing.T) {
+				if _, err := d.DB.Exec(`DROP TABLE NamespaceRoots`); err != nil {
+					t.Fatal(err)
+				}
+			},
+			applied: SchemaLatest() - 6,
+			version: SchemaLatest(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup(t)
+
+			applied, err := d.Migrate(ctx)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("migrate: %v, want error %t", err, tt.wantErr)
+			}
+			if applied != tt.applied {
+				t.Fatalf("applied %d migrations, want %d", applied, tt.applied)
+			}
+
+			version, err := d.SchemaVersion(ctx)
+			if err != nil || version != tt.version {
+				t.Fatalf("schema version %d %v, want %d", version, err, tt.version)
+			}
+		})
+	}
+}
+
+func TestOpenDB(t *testing.T) {
+	tests := []struct {
+		name        string
+		autoMigrate bool
+		wantErr     string
+	}{
+		{name: "auto migrate", autoMigrate: true},
+		{name: "pending migrations", wantErr: "run `retrieve-server db migrate`"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := OpenDB(filepath.Join(t.TempDir(), "test.db"), Options{AutoMigrate: tt.autoMigrate})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			version, err := d.SchemaVersion(context.Background())
+			if err != nil || version != SchemaLatest() {
+				t.Fatalf("schema version %d %v, want %d", version, err, SchemaLatest())
+			}
+		})
+	}
+}
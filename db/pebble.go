@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// keys of the block store, roots and namespaces never contain a "/"
+const (
+	blockPrefix = "b/" // b/<root> holds the block
+	livePrefix  = "n/" // n/<ns>/<root> holds the block size while ns serves root
+	rootPrefix  = "r/" // r/<root>/<ns> indexes the live keys of root
+)
+
+// pebbleStore keeps root blocks and which namespaces serve them in Pebble,
+// so block and size reads run concurrently without the sql db.
+type pebbleStore struct {
+	db *pebble.DB
+}
+
+func (s *pebbleStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *pebbleStore) Block(ns, root string) ([]byte, error) {
+	if _, err := s.get(liveKey(ns, root)); err != nil {
+		return nil, err
+	}
+	return s.Raw(root)
+}
+
+func (s *pebbleStore) Size(ns, root string) (int, error) {
+	v, err := s.get(liveKey(ns, root))
+	if err != nil {
+		return 0, err
+	}
+	size, _ := binary.Uvarint(v)
+	return int(size), nil
+}
+
+func (s *pebbleStore) Raw(root string) ([]byte, error) {
+	return s.get([]byte(blockPrefix + root))
+}
+
+func (s *pebbleStore) get(key []byte) ([]byte, error) {
+	v, closer, err := s.db.Get(key)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil, sql.ErrNoRows
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	return append([]byte(nil), v...), nil
+}
+
+// Backup writes a pebble checkpoint, a consistent copy hard linking the
+// immutable tables of the store.
+func (s *pebbleStore) Backup(dir string) error {
+	return s.db.Checkpoint(dir, pebble.WithFlushedWAL())
+}
+
+// Batch writes the changes of a transaction together.
+func (s *pebbleStore) Batch() BlockBatch {
+	return &pebbleBatch{b: s.db.NewIndexedBatch()}
+}
+
+type pebbleBatch struct {
+	b *pebble.Batch
+}
+
+func (b *pebbleBatch) Put(ns, root string, block []byte) error {
+	if err := b.b.Set([]byte(blockPrefix+root), block, nil); err != nil {
+		return err
+	}
+	return b.show(ns, root, len(block))
+}
+
+func (b *pebbleBatch) Show(ns, root string) error {
+	v, closer, err := b.b.Get([]byte(blockPrefix + root))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return fmt.Errorf("block of %s missing from pebble", root)
+	}
+	if err != nil {
+		return err
+	}
+	size := len(v)
+	closer.Close()
+
+	return b.show(ns, root, size)
+}
+
+func (b *pebbleBatch) show(ns, root string, size int) error {
+	v := binary.AppendUvarint(nil, uint64(size))
+	if err := b.b.Set(liveKey(ns, root), v, nil); err != nil {
+		return err
+	}
+	return b.b.Set([]byte(rootPrefix+root+"/"+ns), nil, nil)
+}
+
+func (b *pebbleBatch) Hide(ns, root string) error {
+	if ns != "" {
+		if err := b.b.Delete(liveKey(ns, root), nil); err != nil {
+			return err
+		}
+		return b.b.Delete([]byte(rootPrefix+root+"/"+ns), nil)
+	}
+
+	namespaces, err := b.namespaces(root)
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		if err := b.Hide(ns, root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *pebbleBatch) Remove(root string) error {
+	if err := b.Hide("", root); err != nil {
+		return err
+	}
+	return b.b.Delete([]byte(blockPrefix+root), nil)
+}
+
+func (b *pebbleBatch) namespaces(root string) ([]string, error) {
+	prefix := []byte(rootPrefix + root + "/")
+	it, err := b.b.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: append(append([]byte(nil), prefix[:len(prefix)-1]...), '/'+1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var namespaces []string
+	for it.First(); it.Valid(); it.Next() {
+		namespaces = append(namespaces, string(it.Key()[len(prefix):]))
+	}
+	return namespaces, it.Error()
+}
+
+// Commit writes the batch and syncs it to disk.
+func (b *pebbleBatch) Commit() error {
+	return b.b.Commit(pebble.Sync)
+}
+
+func (b *pebbleBatch) Close() {
+	b.b.Close()
+}
+
+func liveKey(ns, root string) []byte {
+	return []byte(livePrefix + ns + "/" + root)
+}
+
+func openPebble(dir string) (*pebbleStore, error) {
+	db, err := pebble.Open(dir, &pebble.Options{Logger: log})
+	if err != nil {
+		return nil, fmt.Errorf("open pebble: %w", err)
+	}
+	return &pebbleStore{db: db}, nil
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// blockOp is a change of a block store batch, ns "" hides root everywhere.
+type blockOp struct {
+	op   string // put, show, hide or remove
+	ns   string
+	root string
+}
+
+func applyBlockOps(t *testing.T, s BlockStore, ops []blockOp, commit bool) error {
+	t.Helper()
+
+	b := s.Batch()
+	defer b.Close()
+
+	for _, o := range ops {
+		var err error
+		switch o.op {
+		case "put":
+			err = b.Put(o.ns, o.root, []byte("block of "+o.root))
+		case "show":
+			err = b.Show(o.ns, o.root)
+		case "hide":
+			err = b.Hide(o.ns, o.root)
+		case "remove":
+			err = b.Remove(o.root)
+		default:
+			t.Fatalf("unknown op %s", o.op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if !commit {
+		return nil
+	}
+	return b.Commit()
+}
+
+func TestPebbleStore(t *testing.T) {
+	type served struct {
+		ns, root string
+		want     bool
+	}
+	tests := []struct {
+		name    string
+		batches [][]blockOp
+		// the last batch is closed without committing
+		abort   bool
+		wantErr bool
+		served  []served
+		raw     map[string]bool
+	}{
+		{
+			name:    "put serves the block in its namespace",
+			batches: [][]blockOp{{{"put", "a", "r1"}}},
+			served:  []served{{"a", "r1", true}, {"b", "r1", false}},
+			raw:     map[string]bool{"r1": true},
+		},
+		{
+			name:    "show serves a stored block in another namespace",
+			batches: [][]blockOp{{{"put", "a", "r1"}}, {{"show", "b", "r1"}}},
+			served:  []served{{"a", "r1", true}, {"b", "r1", true}},
+		},
+		{
+			name:    "hide stops one namespace",
+			batches: [][]blockOp{{{"put", "a", "r1"}, {"show", "b", "r1"}}, {{"hide", "a", "r1"}}},
+			served:  []served{{"a", "r1", false}, {"b", "r1", true}},
+			raw:     map[string]bool{"r1": true},
+		},
+		{
+			name:    "hide without a namespace stops all of them",
+			batches: [][]blockOp{{{"put", "a", "r1"}, {"show", "b", "r1"}}, {{"hide", "", "r1"}}},
+			served:  []served{{"a", "r1", false}, {"b", "r1", false}},
+			raw:     map[string]bool{"r1": true},
+		},
+		{
+			name:    "remove deletes the block",
+			batches: [][]blockOp{{{"put", "a", "r1"}, {"put", "a", "r2"}}, {{"remove", "", "r1"}}},
+			served:  []served{{"a", "r1", false}, {"a", "r2", true}},
+			raw:     map[string]bool{"r1": false, "r2": true},
+		},
+		{
+			name:    "show of a missing block fails",
+			batches: [][]blockOp{{{"show", "a", "r1"}}},
+			wantErr: true,
+			served:  []served{{"a", "r1", false}},
+		},
+		{
+			name:    "uncommitted batches change nothing",
+			batches: [][]blockOp{{{"put", "a", "r1"}}, {{"remove", "", "r1"}, {"put", "a", "r2"}}},
+			abort:   true,
+			served:  []served{{"a", "r1", true}, {"a", "r2", false}},
+			raw:     map[string]bool{"r1": true, "r2": false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := openPebble(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			for i, ops := range tt.batches {
+				commit := !tt.abort || i < len(tt.batches)-1
+				err := applyBlockOps(t, s, ops, commit)
+				if tt.wantErr && i == len(tt.batches)-1 {
+					if err == nil {
+						t.Fatalf("batch %d: no error", i)
+					}
+				} else if err != nil {
+					t.Fatalf("batch %d: %v", i, err)
+				}
+			}
+
+			for _, sv := range tt.served {
+				block, err := s.Block(sv.ns, sv.root)
+				if sv.want != (err == nil) {
+					t.Fatalf("%s serves %s: %v, want %t", sv.ns, sv.root, err, sv.want)
+				}
+				if !sv.want && !errors.Is(err, sql.ErrNoRows) {
+					t.Fatalf("%s block %s: %v, want sql.ErrNoRows", sv.ns, sv.root, err)
+				}
+
+				size, err := s.Size(sv.ns, sv.root)
+				if sv.want && (err != nil || size != len(block)) {
+					t.Fatalf("%s size of %s: %d %v, want %d", sv.ns, sv.root, size, err, len(block))
+				}
+			}
+			for root, want := range tt.raw {
+				if _, err := s.Raw(root); want != (err == nil) {
+					t.Fatalf("raw %s: %v, want stored %t", root, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPebbleBackup(t *testing.T) {
+	s, err := openPebble(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := applyBlockOps(t, s, []blockOp{{"put", "a", "r1"}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "backup")
+	if err := s.Backup(dir); err != nil {
+		t.Fatal(err)
+	}
+	// changes after the backup are not in it
+	if err := applyBlockOps(t, s, []blockOp{{"put", "a", "r2"}}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := openPebble(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if block, err := b.Block("a", "r1"); err != nil || string(block) != "block of r1" {
+		t.Fatalf("backup block: %q %v", block, err)
+	}
+	if _, err := b.Block("a", "r2"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("block written after the backup: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const checkTimeout = 5 * time.Second
+
+// Check reports whether a dependency is usable, a nil error means ready.
+type Check func(ctx context.Context) error
+
+type CheckStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Status struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckStatus `json:"checks"`
+}
+
+type Checker struct {
+	lk       sync.Mutex
+	names    []string
+	checks   map[string]Check
+	draining bool
+}
+
+func New() *Checker {
+	return &Checker{
+		checks: make(map[string]Check),
+	}
+}
+
+func (c *Checker) Add(name string, check Check) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	if _, ok := c.checks[name]; !ok {
+		c.names = append(c.names, name)
+	}
+	c.checks[name] = check
+}
+
+// Drain makes the readiness probe fail from now on, so load balancers stop
+// routing to a process that is shutting down.
+func (c *Checker) Drain() {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	c.draining = true
+}
+
+// Run runs all checks concurrently and reports "ok" only if all of them
+// pass and the process is not draining.
+func (c *Checker) Run(ctx context.Context) Status {
+	c.lk.Lock()
+	names := append([]string(nil), c.names...)
+	checks := make([]Check, len(names))
+	for i, name := range names {
+		checks[i] = c.checks[name]
+	}
+	draining := c.draining
+	c.lk.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	results := make([]CheckStatus, len(names))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			if err := check(ctx); err != nil {
+				results[i] = CheckStatus{Status: "fail", Error: err.Error()}
+				return
+			}
+			results[i] = CheckStatus{Status: "ok"}
+		}(i, check)
+	}
+	wg.Wait()
+
+	st := Status{
+		Status: "ok",
+		Checks: make(map[string]CheckStatus, len(names)),
+	}
+	for i, name := range names {
+		st.Checks[name] = results[i]
+		if results[i].Status != "ok" {
+			st.Status = "fail"
+		}
+	}
+	if draining {
+		st.Status = "draining"
+	}
+
+	return st
+}
+
+// Healthz is the liveness probe, it only reports that the process serves http.
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// Readyz is the readiness probe, it answers 503 with the per-dependency
+// status when any check fails.
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	st := c.Run(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if st.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
+
+func (c *Checker) Handle(mux *http.ServeMux) {
+	mux.HandleFunc("GET /healthz", c.Healthz)
+	mux.HandleFunc("GET /readyz", c.Readyz)
+}
@@ -11,19 +11,48 @@ import (
 
 // Distribution
 var defaultMillisecondsDistribution = view.Distribution(0.01, 0.05, 0.1, 0.3, 0.6, 0.8, 1, 2, 3, 4, 5, 6, 8, 10, 13, 16, 20, 25, 30, 40, 50, 65, 80, 100, 130, 160, 200, 250, 300, 400, 500, 650, 800, 1000, 2000, 3000, 4000, 5000, 7500, 10000, 20000, 50000, 100_000, 250_000, 500_000, 1000_000)
+var defaultBytesDistribution = view.Distribution(64, 256, 1<<10, 4<<10, 16<<10, 64<<10, 256<<10, 1<<20, 2<<20, 4<<20, 8<<20, 16<<20, 64<<20, 256<<20)
 
 // Tags
 var (
 	Version, _ = tag.NewKey("version")
 	Commit, _  = tag.NewKey("commit")
 
-	Endpoint, _ = tag.NewKey("endpoint")
+	Endpoint, _    = tag.NewKey("endpoint")
+	Status, _      = tag.NewKey("status")
+	StatusClass, _ = tag.NewKey("status_class")
+	Reason, _      = tag.NewKey("reason")
+	Operation, _   = tag.NewKey("operation")
+	Backend, _     = tag.NewKey("backend")
+	Tenant, _      = tag.NewKey("tenant")
 )
 
 // Measures
 var (
 	Info               = stats.Int64("info", "Arbitrary counter to tag rtb info to", stats.UnitDimensionless)
 	APIRequestDuration = stats.Float64("api/request_duration_ms", "Duration of API requests", stats.UnitMilliseconds)
+	APIRequests        = stats.Int64("api/requests", "API requests by endpoint and status code", stats.UnitDimensionless)
+	APIRequestBytes    = stats.Int64("api/request_bytes", "Size of API request bodies", stats.UnitBytes)
+	APIResponseBytes   = stats.Int64("api/response_bytes", "Size of API response bodies", stats.UnitBytes)
+	Panics             = stats.Int64("api/panics", "Handler panics recovered as 500 responses", stats.UnitDimensionless)
+	RejectedRequests   = stats.Int64("api/rejected_requests", "Requests rejected by rate limits or the in-flight cap", stats.UnitDimensionless)
+	InFlightRequests   = stats.Int64("api/in_flight_requests", "Requests holding an in-flight slot", stats.UnitDimensionless)
+
+	BlockSize     = stats.Int64("block/size", "Size of root blocks stored and served", stats.UnitBytes)
+	DeletedRoots  = stats.Int64("block/deleted_roots", "Roots deleted, by reason", stats.UnitDimensionless)
+	DeletedBytes  = stats.Int64("block/deleted_bytes", "Bytes of root blocks deleted, by reason", stats.UnitBytes)
+	ArchivedRoots = stats.Int64("block/archived_roots", "Expired roots written to an archive car before deletion", stats.UnitDimensionless)
+
+	TenantRoots     = stats.Int64("tenant/roots", "Live roots stored by a tenant", stats.UnitDimensionless)
+	TenantBytes     = stats.Int64("tenant/bytes", "Bytes of live roots stored by a tenant", stats.UnitBytes)
+	QuotaRejections = stats.Int64("tenant/quota_rejections", "Uploads rejected because the tenant is over quota", stats.UnitDimensionless)
+
+	DBQueryDuration    = stats.Float64("db/query_duration_ms", "Duration of DB queries", stats.UnitMilliseconds)
+	DBOpenConnections  = stats.Int64("db/open_connections", "Established DB connections, in use and idle", stats.UnitDimensionless)
+	DBInUseConnections = stats.Int64("db/in_use_connections", "DB connections currently in use", stats.UnitDimensionless)
+	DBIdleConnections  = stats.Int64("db/idle_connections", "Idle DB connections", stats.UnitDimensionless)
+	DBWaitCount        = stats.Int64("db/wait_count", "Total DB connections waited for", stats.UnitDimensionless)
+	DBWaitDuration     = stats.Float64("db/wait_duration_ms", "Total time blocked waiting for a DB connection", stats.UnitMilliseconds)
 )
 
 // Views
@@ -38,13 +67,125 @@ var (
 	APIRequestDurationView = &view.View{
 		Measure:     APIRequestDuration,
 		Aggregation: defaultMillisecondsDistribution,
+		TagKeys:     []tag.Key{Endpoint, StatusClass},
+	}
+	APIRequestsView = &view.View{
+		Measure:     APIRequests,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Endpoint, Status},
+	}
+	APIRequestBytesView = &view.View{
+		Measure:     APIRequestBytes,
+		Aggregation: defaultBytesDistribution,
+		TagKeys:     []tag.Key{Endpoint},
+	}
+	APIResponseBytesView = &view.View{
+		Measure:     APIResponseBytes,
+		Aggregation: defaultBytesDistribution,
+		TagKeys:     []tag.Key{Endpoint},
+	}
+	PanicsView = &view.View{
+		Measure:     Panics,
+		Aggregation: view.Count(),
 		TagKeys:     []tag.Key{Endpoint},
 	}
+	RejectedRequestsView = &view.View{
+		Measure:     RejectedRequests,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Reason},
+	}
+	InFlightRequestsView = &view.View{
+		Measure:     InFlightRequests,
+		Aggregation: view.LastValue(),
+	}
+	BlockSizeView = &view.View{
+		Measure:     BlockSize,
+		Aggregation: defaultBytesDistribution,
+		TagKeys:     []tag.Key{Operation},
+	}
+	DeletedRootsView = &view.View{
+		Measure:     DeletedRoots,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{Reason},
+	}
+	DeletedBytesView = &view.View{
+		Measure:     DeletedBytes,
+		Aggregation: view.Sum(),
+		TagKeys:     []tag.Key{Reason},
+	}
+	ArchivedRootsView = &view.View{
+		Measure:     ArchivedRoots,
+		Aggregation: view.Sum(),
+	}
+	TenantRootsView = &view.View{
+		Measure:     TenantRoots,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Tenant},
+	}
+	TenantBytesView = &view.View{
+		Measure:     TenantBytes,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Tenant},
+	}
+	QuotaRejectionsView = &view.View{
+		Measure:     QuotaRejections,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{Tenant, Reason},
+	}
+	DBQueryDurationView = &view.View{
+		Measure:     DBQueryDuration,
+		Aggregation: defaultMillisecondsDistribution,
+		TagKeys:     []tag.Key{Operation, Backend},
+	}
+	DBOpenConnectionsView = &view.View{
+		Measure:     DBOpenConnections,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	DBInUseConnectionsView = &view.View{
+		Measure:     DBInUseConnections,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	DBIdleConnectionsView = &view.View{
+		Measure:     DBIdleConnections,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	DBWaitCountView = &view.View{
+		Measure:     DBWaitCount,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Backend},
+	}
+	DBWaitDurationView = &view.View{
+		Measure:     DBWaitDuration,
+		Aggregation: view.LastValue(),
+		TagKeys:     []tag.Key{Backend},
+	}
 )
 
 var Views = []*view.View{
 	InfoView,
 	APIRequestDurationView,
+	APIRequestsView,
+	APIRequestBytesView,
+	APIResponseBytesView,
+	PanicsView,
+	RejectedRequestsView,
+	InFlightRequestsView,
+	BlockSizeView,
+	DeletedRootsView,
+	DeletedBytesView,
+	ArchivedRootsView,
+	TenantRootsView,
+	TenantBytesView,
+	QuotaRejectionsView,
+	DBQueryDurationView,
+	DBOpenConnectionsView,
+	DBInUseConnectionsView,
+	DBIdleConnectionsView,
+	DBWaitCountView,
+	DBWaitDurationView,
 }
 
 // SinceInMilliseconds returns the duration of time since the provide time as a float64.
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gh-efforts/retrieve-server/requestid"
+	"github.com/ipfs/go-cid"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type AccessLogConfig struct {
+	// Output is "stdout", "stderr" or a file path, files are rotated by size.
+	Output string
+	// SampleRate is the fraction of successful requests logged, failed
+	// requests are always logged.
+	SampleRate float64
+
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+}
+
+// AccessLog writes one json record per request, independent of the
+// go-log levels.
+type AccessLog struct {
+	logger     *zap.Logger
+	closer     io.Closer
+	sampleRate float64
+	identify   func(r *http.Request) string
+}
+
+// NewAccessLog returns an access log, identify returns the authenticated
+// identity recorded for a request, nil records none.
+func NewAccessLog(conf AccessLogConfig, identify func(r *http.Request) string) *AccessLog {
+	var ws zapcore.WriteSyncer
+	var closer io.Closer
+	switch conf.Output {
+	case "stdout":
+		ws = zapcore.Lock(os.Stdout)
+	case "stderr":
+		ws = zapcore.Lock(os.Stderr)
+	default:
+		lj := &lumberjack.Logger{
+			Filename:   conf.Output,
+			MaxSize:    conf.MaxSizeMB,
+			MaxBackups: conf.MaxBackups,
+			MaxAge:     conf.MaxAgeDays,
+		}
+		ws = zapcore.AddSync(lj)
+		closer = lj
+	}
+
+	encConf := zap.NewProductionEncoderConfig()
+	encConf.TimeKey = "time"
+	encConf.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(encConf), ws, zapcore.InfoLevel)
+	return &AccessLog{
+		logger:     zap.New(core),
+		closer:     closer,
+		sampleRate: conf.SampleRate,
+		identify:   identify,
+	}
+}
+
+func (a *AccessLog) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := newResponseWriter(w)
+
+		defer func() {
+			status := rw.Status()
+			if status < 400 && a.sampleRate < 1 && rand.Float64() >= a.sampleRate {
+				return
+			}
+
+			var identity string
+			if a.identify != nil {
+				identity = a.identify(r)
+			}
+
+			a.logger.Info("access",
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.String("root", rootFromPath(r.URL.Path)),
+				zap.String("identity", identity),
+				zap.String("ns", nsFromPath(r.URL.Path)),
+				zap.Int("status", status),
+				zap.Int64("bytes", rw.bytes),
+				zap.Int64("request_bytes", r.ContentLength),
+				zap.Float64("latency_ms", float64(time.Since(start).Nanoseconds())/1e6),
+				zap.String("remote_addr", r.RemoteAddr),
+				zap.String("forwarded_for", r.Header.Get("X-Forwarded-For")),
+				zap.String("user_agent", r.UserAgent()),
+				zap.String("request_id", requestid.FromContext(r.Context())),
+			)
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (a *AccessLog) Close() error {
+	a.logger.Sync()
+	if a.closer != nil {
+		return a.closer.Close()
+	}
+	return nil
+}
+
+// nsFromPath returns the namespace of /ns/{ns}/... paths, "" for the paths
+// of the default namespace and those outside one.
+func nsFromPath(path string) string {
+	rest, ok := strings.CutPrefix(path, "/ns/")
+	if !ok {
+		return ""
+	}
+	ns, _, _ := strings.Cut(rest, "/")
+	return ns
+}
+
+// rootFromPath returns the first path segment that parses as a cid, which
+// is the root for /block/{root}, /size/{root} and /ipfs/{root}/... paths.
+func rootFromPath(path string) string {
+	for _, seg := range strings.Split(path, "/") {
+		if len(seg) < 8 {
+			continue
+		}
+		if _, err := cid.Decode(seg); err == nil {
+			return seg
+		}
+	}
+	return ""
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessLogTenant(t *testing.T) {
+	identify := func(r *http.Request) string {
+		if r.Header.Get("Authorization") == "Bearer valid" {
+			return "alice"
+		}
+		return ""
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		token    string
+		identity string
+		ns       string
+	}{
+		{name: "default namespace", path: "/block/x", token: "valid", identity: "alice"},
+		{name: "namespace", path: "/ns/team1/block/x", token: "valid", identity: "alice", ns: "team1"},
+		{name: "namespace roots", path: "/ns/team1/roots", ns: "team1"},
+		{name: "unknown token", path: "/block/x", token: "made-up"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "access.log")
+			a := NewAccessLog(AccessLogConfig{Output: out, SampleRate: 1}, identify)
+
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			a.Wrap(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), r)
+			if err := a.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := os.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rec struct {
+				Identity string `json:"identity"`
+				NS       string `json:"ns"`
+			}
+			if err := json.Unmarshal(data, &rec); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Identity != tt.identity || rec.NS != tt.ns {
+				t.Fatalf("identity %q ns %q, want %q %q", rec.Identity, rec.NS, tt.identity, tt.ns)
+			}
+		})
+	}
+}
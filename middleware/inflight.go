@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Tracker counts the requests being served, so shutdown can report the
+// ones it had to abort.
+type Tracker struct {
+	active atomic.Int64
+}
+
+func (t *Tracker) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.active.Add(1)
+		defer t.active.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Active returns the number of requests being served.
+func (t *Tracker) Active() int64 {
+	return t.active.Load()
+}
@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gh-efforts/retrieve-server/metrics"
+	"github.com/gh-efforts/retrieve-server/requestid"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"golang.org/x/time/rate"
+)
+
+// idle client buckets are dropped after this long
+const bucketTTL = 10 * time.Minute
+
+type Limits struct {
+	// Rate is the sustained requests per second allowed for one client,
+	// zero disables per-client limiting.
+	Rate  float64
+	Burst int
+
+	// MaxInFlight caps the requests served at once, zero disables the cap.
+	// Up to MaxQueue requests wait at most QueueTimeout for a free slot.
+	MaxInFlight  int
+	MaxQueue     int
+	QueueTimeout time.Duration
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type Limiter struct {
+	identify func(r *http.Request) string
+
+	lk        sync.Mutex
+	limits    Limits
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	slots     chan struct{}
+
+	queueLk sync.Mutex
+	queued  int
+}
+
+// NewLimiter returns a limiter keyed by client ip, identify returns the
+// identity of a validated token which then gets a bucket of its own. The
+// limiter runs before auth, so made up tokens must not get one. A nil
+// identify keys every request by its ip.
+func NewLimiter(limits Limits, identify func(r *http.Request) string) *Limiter {
+	l := &Limiter{
+		identify:  identify,
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+	l.SetLimits(limits)
+
+	return l
+}
+
+// SetLimits replaces the limits while requests are served. Existing client
+// buckets keep their tokens, requests holding a slot of the old in-flight
+// cap release it when they finish.
+func (l *Limiter) SetLimits(limits Limits) {
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	for _, b := range l.buckets {
+		b.limiter.SetLimit(rate.Limit(limits.Rate))
+		b.limiter.SetBurst(max(limits.Burst, 1))
+	}
+
+	if limits.MaxInFlight != l.limits.MaxInFlight {
+		l.slots = nil
+		if limits.MaxInFlight > 0 {
+			l.slots = make(chan struct{}, limits.MaxInFlight)
+		}
+	}
+
+	l.limits = limits
+}
+
+// Wrap rejects requests over the client rate or the in-flight cap with 429.
+func (l *Limiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := l.clientKey(r)
+		if !l.allow(key) {
+			reject(w, r, "rate_limit")
+			log.Debugw("rate limited", "requestID", requestid.FromContext(r.Context()), "path", r.URL.Path, "remoteAddr", r.RemoteAddr)
+			return
+		}
+
+		release, reason := l.acquire(r.Context())
+		if reason != "" {
+			reject(w, r, reason)
+			log.Debugw("in-flight cap reached", "requestID", requestid.FromContext(r.Context()), "reason", reason, "path", r.URL.Path, "remoteAddr", r.RemoteAddr)
+			return
+		}
+		defer release()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *Limiter) allow(key string) bool {
+	now := time.Now()
+
+	l.lk.Lock()
+	defer l.lk.Unlock()
+
+	if l.limits.Rate <= 0 {
+		return true
+	}
+
+	if now.Sub(l.lastSweep) > bucketTTL {
+		for k, b := range l.buckets {
+			if now.Sub(b.lastSeen) > bucketTTL {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(l.limits.Rate), max(l.limits.Burst, 1))}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	return b.limiter.AllowN(now, 1)
+}
+
+// acquire takes an in-flight slot, reason is set when the request has to be rejected.
+func (l *Limiter) acquire(ctx context.Context) (release func(), reason string) {
+	l.lk.Lock()
+	slots, limits := l.slots, l.limits
+	l.lk.Unlock()
+
+	if slots == nil {
+		return func() {}, ""
+	}
+
+	release = func() {
+		<-slots
+		stats.Record(context.Background(), metrics.InFlightRequests.M(int64(len(slots))))
+	}
+
+	select {
+	case slots <- struct{}{}:
+		stats.Record(context.Background(), metrics.InFlightRequests.M(int64(len(slots))))
+		return release, ""
+	default:
+	}
+
+	l.queueLk.Lock()
+	if l.queued >= limits.MaxQueue {
+		l.queueLk.Unlock()
+		return nil, "queue_full"
+	}
+	l.queued++
+	l.queueLk.Unlock()
+
+	defer func() {
+		l.queueLk.Lock()
+		l.queued--
+		l.queueLk.Unlock()
+	}()
+
+	timer := time.NewTimer(limits.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case slots <- struct{}{}:
+		stats.Record(context.Background(), metrics.InFlightRequests.M(int64(len(slots))))
+		return release, ""
+	case <-timer.C:
+		return nil, "queue_timeout"
+	case <-ctx.Done():
+		return nil, "canceled"
+	}
+}
+
+// clientKey identifies the caller by the identity of its token, or by
+// remote ip for anonymous requests and tokens that are not valid.
+func (l *Limiter) clientKey(r *http.Request) string {
+	if l.identify != nil {
+		if id := l.identify(r); id != "" {
+			return "id:" + id
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func reject(w http.ResponseWriter, r *http.Request, reason string) {
+	ctx, _ := tag.New(context.Background(), tag.Upsert(metrics.Reason, reason))
+	stats.Record(ctx, metrics.RejectedRequests.M(1))
+
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLimiterKeys(t *testing.T) {
+	identify := func(r *http.Request) string {
+		if r.Header.Get("Authorization") == "Bearer valid" {
+			return "alice"
+		}
+		return ""
+	}
+
+	type req struct {
+		remote string
+		token  string
+		want   int
+	}
+	tests := []struct {
+		name string
+		reqs []req
+	}{
+		{
+			name: "anonymous requests share the ip bucket",
+			reqs: []req{
+				{remote: "10.0.0.1:1000", want: http.StatusOK},
+				{remote: "10.0.0.1:1001", want: http.StatusTooManyRequests},
+				{remote: "10.0.0.1:1002", want: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name: "made up tokens do not skip the ip bucket",
+			reqs: []req{
+				{remote: "10.0.0.1:1000", token: "x1", want: http.StatusOK},
+				{remote: "10.0.0.1:1000", token: "x2", want: http.StatusTooManyRequests},
+				{remote: "10.0.0.1:1000", token: "x3", want: http.StatusTooManyRequests},
+				{remote: "10.0.0.1:1000", token: "x4", want: http.StatusTooManyRequests},
+				{remote: "10.0.0.1:1000", token: "x5", want: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name: "valid tokens get a bucket of their own",
+			reqs: []req{
+				{remote: "10.0.0.1:1000", want: http.StatusOK},
+				{remote: "10.0.0.1:1000", want: http.StatusTooManyRequests},
+				{remote: "10.0.0.1:1000", token: "valid", want: http.StatusOK},
+				{remote: "10.0.0.2:1000", token: "valid", want: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name: "other ips are not limited",
+			reqs: []req{
+				{remote: "10.0.0.1:1000", want: http.StatusOK},
+				{remote: "10.0.0.2:1000", want: http.StatusOK},
+				{remote: "10.0.0.1:1000", want: http.StatusTooManyRequests},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(Limits{Rate: 0.1, Burst: 1}, identify)
+			h := l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			for i, rq := range tt.reqs {
+				r := httptest.NewRequest(http.MethodGet, "/block/x", nil)
+				r.RemoteAddr = rq.remote
+				if rq.token != "" {
+					r.Header.Set("Authorization", "Bearer "+rq.token)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+
+				if w.Code != rq.want {
+					t.Fatalf("request %d: status %d, want %d", i, w.Code, rq.want)
+				}
+			}
+			if n := len(l.buckets); n > 2 {
+				t.Fatalf("%d buckets, made up tokens must not add any", n)
+			}
+		})
+	}
+}
+
+func TestLimiterInFlight(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		want   int
+	}{
+		{name: "no cap", limits: Limits{}, want: http.StatusOK},
+		{name: "full queue", limits: Limits{MaxInFlight: 1}, want: http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(tt.limits, nil)
+
+			// hold the only slot while the request is served
+			release, reason := l.acquire(context.Background())
+			if reason != "" {
+				t.Fatalf("acquire: %s", reason)
+			}
+			defer release()
+
+			h := l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
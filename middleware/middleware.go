@@ -1,24 +1,95 @@
 package middleware
 
 import (
-	"context"
+	"fmt"
 	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
 
 	"github.com/gh-efforts/retrieve-server/metrics"
+	"github.com/gh-efforts/retrieve-server/requestid"
 	logging "github.com/ipfs/go-log/v2"
+	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 )
 
 var log = logging.Logger("middleware")
 
-func Timer(handler http.HandlerFunc, name string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		log.Debugw("request", "method", r.Method, "path", r.URL.Path, "name", name, "remoteAddr", r.RemoteAddr)
+type Middleware func(http.Handler) http.Handler
 
-		ctx, _ := tag.New(context.Background(), tag.Upsert(metrics.Endpoint, name))
-		stop := metrics.Timer(ctx, metrics.APIRequestDuration)
-		defer stop()
+// Chain wraps h so that the first middleware is the outermost one.
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Handler wraps an api endpoint with the standard chain, name is used as
+// the endpoint tag of its metrics.
+func Handler(handler http.HandlerFunc, name string) http.Handler {
+	return Chain(handler, Instrument(name), Trace(name), Recover)
+}
+
+// Instrument tags the request context with the endpoint name and records
+// latency, status, and body sizes once the handler returns.
+func Instrument(name string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log.Debugw("request", "requestID", requestid.FromContext(r.Context()), "method", r.Method, "path", r.URL.Path, "name", name, "remoteAddr", r.RemoteAddr)
+
+			ctx, _ := tag.New(r.Context(), tag.Upsert(metrics.Endpoint, name))
+			start := time.Now()
+
+			rw := newResponseWriter(w)
+			body := &countingReader{ReadCloser: r.Body}
+			r.Body = body
+
+			defer func() {
+				status := rw.Status()
+				sctx, _ := tag.New(ctx,
+					tag.Upsert(metrics.Status, strconv.Itoa(status)),
+					tag.Upsert(metrics.StatusClass, statusClass(status)),
+				)
+				stats.Record(sctx,
+					metrics.APIRequestDuration.M(metrics.SinceInMilliseconds(start)),
+					metrics.APIRequests.M(1),
+				)
+				stats.Record(ctx, metrics.APIRequestBytes.M(body.bytes), metrics.APIResponseBytes.M(rw.bytes))
+			}()
 
-		handler(w, r)
+			next.ServeHTTP(rw, r.WithContext(ctx))
+		})
 	}
 }
+
+// Recover turns a handler panic into a 500 response, the panic is logged
+// with its stack and counted.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+
+			log.Errorw("panic serving request", "requestID", requestid.FromContext(r.Context()), "method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(rec), "stack", string(debug.Stack()))
+			stats.Record(r.Context(), metrics.Panics.M(1))
+
+			if rw, ok := w.(*responseWriter); ok && rw.Written() {
+				return
+			}
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
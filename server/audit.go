@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gh-efforts/retrieve-server/auth"
+	"github.com/gh-efforts/retrieve-server/db"
+	"github.com/gh-efforts/retrieve-server/middleware"
+	"github.com/gh-efforts/retrieve-server/requestid"
+)
+
+// actions recorded in the audit log
+const (
+	ActionUpsert   = "upsert"
+	ActionDelete   = "delete"
+	ActionUndelete = "undelete"
+	ActionExpire   = "expire"
+	ActionPurge    = "purge"
+)
+
+const defaultAuditLimit = 100
+
+// AuditEntry is one change of a root, detail holds the source of upserts.
+// Changes of a root in every namespace, such as expiry, have no namespace.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	At        time.Time `json:"at"`
+	Action    string    `json:"action"`
+	Namespace string    `json:"ns,omitempty"`
+	Root      string    `json:"root"`
+	Actor     string    `json:"actor"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// audit appends an entry to the audit log in the transaction of the change.
+func audit(ctx context.Context, tx *sql.Tx, at time.Time, action, ns, root, actor, detail string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO AuditLog(at, action, ns, root, actor, detail) VALUES ($1, $2, $3, $4, $5, $6)`,
+		at, action, ns, root, actor, detail)
+	return err
+}
+
+// HandleAdmin registers the endpoints that are only served to admins.
+func (s *Server) HandleAdmin(mux *http.ServeMux) {
+	mux.Handle("POST /admin/undelete/{root}", middleware.Handler(s.undeleteHandle, "undelete"))
+	mux.Handle("GET /admin/audit", middleware.Handler(s.auditHandle, "audit"))
+	mux.Handle("POST /admin/delete", middleware.Handler(s.bulkDeleteHandle, "bulk_delete"))
+	mux.Handle("GET /admin/tenants/{id}/usage", middleware.Handler(s.usageHandle, "tenant_usage"))
+	mux.Handle("GET /admin/namespaces", middleware.Handler(s.namespacesHandle, "namespaces"))
+	mux.Handle("DELETE /admin/namespaces/{ns}", middleware.Handler(s.deleteNamespaceHandle, "delete_namespace"))
+	mux.Handle("POST /admin/backup", middleware.Handler(s.backupHandle, "backup"))
+}
+
+// undelete clears the tombstone of root in ns and of its block, it returns
+// sql.ErrNoRows when the root is not deleted or was already purged. A block
+// that comes back counts against the quota of its uploader again.
+func (s *Server) undelete(ctx context.Context, ns string, root string) error {
+	ctx, span := s.startSpan(ctx, "undelete", root)
+	stop := s.d.Timer("undelete")
+	err := s.withBlocksTx(ctx, func(tx *sql.Tx, bb db.BlockBatch) error {
+		res, err := tx.ExecContext(ctx, `UPDATE NamespaceRoots SET deleted_at=NULL WHERE ns=$1 AND root=$2 AND deleted_at IS NOT NULL`, ns, root)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+
+		var uploader string
+		var size int
+		err = tx.QueryRowContext(ctx, `SELECT uploader, size FROM RootBlocks WHERE root=$1 AND deleted_at IS NOT NULL`, root).Scan(&uploader, &size)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// another namespace kept the block live
+		case err != nil:
+			return err
+		default:
+			if err := s.checkQuota(ctx, tx, uploader, root, size); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE RootBlocks SET deleted_at=NULL, deleted_by='' WHERE root=$1`, root); err != nil {
+				return err
+			}
+		}
+
+		if err := bb.Show(ns, root); err != nil {
+			return err
+		}
+		return audit(ctx, tx, time.Now().UTC(), ActionUndelete, ns, root, auth.IdentityFromContext(ctx), "")
+	})
+	stop()
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+
+	log.Infow("undelete", "requestID", requestid.FromContext(ctx), "ns", ns, "root", root)
+	return nil
+}
+
+// auditLog returns the entries of ns and root recorded in [since, until),
+// empty filters match everything and zero times leave that end open.
+func (s *Server) auditLog(ctx context.Context, ns, root string, since, until time.Time, limit int) ([]AuditEntry, error) {
+	var where []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if ns != "" {
+		add("ns = $%d", ns)
+	}
+	if root != "" {
+		add("root = $%d", root)
+	}
+	if !since.IsZero() {
+		add("at >= $%d", since.UTC())
+	}
+	if !until.IsZero() {
+		add("at < $%d", until.UTC())
+	}
+
+	query := `SELECT id, at, action, ns, root, actor, detail FROM AuditLog`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(" ORDER BY id LIMIT $%d", len(args))
+
+	ctx, span := s.startSpan(ctx, "audit", root)
+	stop := s.d.Timer("audit")
+	defer stop()
+
+	rows, err := s.d.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.At, &e.Action, &e.Namespace, &e.Root, &e.Actor, &e.Detail); err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	err = rows.Err()
+	endSpan(span, err)
+
+	return entries, err
+}
+
+// undeleteHandle restores a root in the namespace of the "ns" query
+// parameter, the default one when it is not set.
+func (s *Server) undeleteHandle(w http.ResponseWriter, r *http.Request) {
+	ns := r.URL.Query().Get("ns")
+	if ns == "" {
+		ns = DefaultNamespace
+	}
+
+	err := s.undelete(r.Context(), ns, r.PathValue("root"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+}
+
+// auditHandle lists audit entries filtered by the "ns", "root", "since" and
+// "until" query parameters, the times are RFC 3339.
+func (s *Server) auditHandle(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var since, until time.Time
+	for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s: %s", name, err), http.StatusBadRequest)
+			return
+		}
+		*t = parsed
+	}
+
+	limit := defaultAuditLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit: %s", v), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	entries, err := s.auditLog(r.Context(), q.Get("ns"), q.Get("root"), since, until, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
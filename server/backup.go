@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gh-efforts/retrieve-server/requestid"
+)
+
+var (
+	errBackupUnsupported = errors.New("online backup needs a sqlite, pebble:// or flatfs:// db, back up postgres with its own tools")
+	errBackupDisabled    = errors.New("online backup is disabled, set db.backup_dir")
+	errBackupName        = errors.New("backup name must be a relative path inside the backup dir")
+)
+
+// backup writes a copy of the db to the new directory name in the backup
+// dir while the server keeps serving, meta.db in it is the sqlite db and
+// blocks the block store of a pebble:// or flatfs:// db, which opens again
+// with the directory as its path. Writes wait for the copy so both stores
+// are copied at the same commit.
+func (s *Server) backup(ctx context.Context, name string) error {
+	if s.d.DBType != "sqlite" {
+		return errBackupUnsupported
+	}
+	if s.opts.BackupDir == "" {
+		return errBackupDisabled
+	}
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("%w: %s", errBackupName, name)
+	}
+
+	dir := filepath.Join(s.opts.BackupDir, name)
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("backup dir %s exists", dir)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	ctx, span := s.startSpan(ctx, "backup", "")
+	stop := s.d.Timer("backup")
+	start := time.Now()
+
+	s.blockLk.Lock()
+	_, err := s.d.DB.ExecContext(ctx, `VACUUM INTO $1`, filepath.Join(dir, "meta.db"))
+	if err == nil && s.d.Blocks != nil {
+		err = s.d.Blocks.Backup(filepath.Join(dir, "blocks"))
+	}
+	s.blockLk.Unlock()
+
+	stop()
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+
+	log.Infow("backup", "requestID", requestid.FromContext(ctx), "dir", dir, "took", time.Since(start))
+	return nil
+}
+
+// backupHandle backs the db up to the directory the dir parameter names in
+// the backup dir of the server host.
+func (s *Server) backupHandle(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Query().Get("dir")
+	if dir == "" {
+		http.Error(w, "missing dir", http.StatusBadRequest)
+		return
+	}
+
+	err := s.backup(r.Context(), dir)
+	switch {
+	case errors.Is(err, errBackupUnsupported), errors.Is(err, errBackupDisabled):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case errors.Is(err, errBackupName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupHandle(t *testing.T) {
+	tests := []struct {
+		name string
+		// backup dir of the server, "-" sets none
+		backupDir string
+		dir       string
+		status    int
+	}{
+		{name: "new dir", dir: "b1", status: http.StatusOK},
+		{name: "nested dir", dir: "daily/b1", status: http.StatusOK},
+		{name: "missing dir", status: http.StatusBadRequest},
+		{name: "dir outside the backup dir", dir: "../b1", status: http.StatusBadRequest},
+		{name: "absolute dir", dir: "/tmp/b1", status: http.StatusBadRequest},
+		{name: "backups disabled", backupDir: "-", dir: "b1", status: http.StatusNotImplemented},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backupDir := t.TempDir()
+			if tt.backupDir == "-" {
+				backupDir = ""
+			}
+			s := newTestServer(t, Options{BackupDir: backupDir})
+
+			w := httptest.NewRecorder()
+			s.backupHandle(w, httptest.NewRequest("POST", "/admin/backup?dir="+url.QueryEscape(tt.dir), nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+
+			if tt.status == http.StatusOK {
+				if _, err := os.Stat(filepath.Join(backupDir, tt.dir, "meta.db")); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gh-efforts/retrieve-server/auth"
+	"github.com/gh-efforts/retrieve-server/db"
+	"github.com/gh-efforts/retrieve-server/requestid"
+	"github.com/ipfs/go-cid"
+)
+
+const defaultBulkBatchSize = 1000
+
+var errEmptyFilter = errors.New("filter matches every root, set at least one condition")
+
+// DeleteFilter selects the roots of a bulk delete, all set conditions have
+// to match. Roots stored before creation times were recorded count as
+// created before any time.
+type DeleteFilter struct {
+	Roots         []string   `json:"roots,omitempty"`
+	Provider      string     `json:"provider,omitempty"`
+	PieceCid      string     `json:"piece_cid,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	MinSize       *int64     `json:"min_size,omitempty"`
+	MaxSize       *int64     `json:"max_size,omitempty"`
+	// DryRun only counts the matching roots.
+	DryRun bool `json:"dry_run,omitempty"`
+	// BatchSize is the number of roots deleted per transaction.
+	BatchSize int `json:"batch_size,omitempty"`
+}
+
+// DeleteResult reports the roots and bytes a bulk delete removed, or would
+// remove on a dry run.
+type DeleteResult struct {
+	Roots  int64 `json:"roots"`
+	Bytes  int64 `json:"bytes"`
+	DryRun bool  `json:"dry_run"`
+}
+
+// conditions returns the where clause of f without the root list, the
+// placeholders are numbered from 1 in the order of args.
+func (f *DeleteFilter) conditions() ([]string, []any, error) {
+	where := []string{"deleted_at IS NULL"}
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if f.Provider != "" {
+		add("root IN (SELECT root FROM RootDeals WHERE provider = $%d)", f.Provider)
+	}
+	if f.PieceCid != "" {
+		c, err := parsePieceCid(f.PieceCid)
+		if err != nil {
+			return nil, nil, err
+		}
+		add("root IN (SELECT root FROM RootDeals WHERE piece_cid = $%d)", c.String())
+	}
+	if f.CreatedBefore != nil {
+		add("(created_at < $%d OR created_at IS NULL)", f.CreatedBefore.UTC())
+	}
+	if f.MinSize != nil {
+		add("size >= $%d", *f.MinSize)
+	}
+	if f.MaxSize != nil {
+		add("size <= $%d", *f.MaxSize)
+	}
+
+	if len(args) == 0 && len(f.Roots) == 0 {
+		return nil, nil, errEmptyFilter
+	}
+
+	return where, args, nil
+}
+
+// bulkDelete deletes the roots matching f from every namespace, one batch
+// per transaction. A listed root is processed in the batch of its chunk of the
+// list so the query stays within the placeholder limits of the db.
+func (s *Server) bulkDelete(ctx context.Context, f *DeleteFilter) (*DeleteResult, error) {
+	if f.BatchSize <= 0 {
+		f.BatchSize = defaultBulkBatchSize
+	}
+
+	where, args, err := f.conditions()
+	if err != nil {
+		return nil, err
+	}
+
+	roots := make([]string, len(f.Roots))
+	for i, r := range f.Roots {
+		c, err := cid.Parse(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root %s: %w", r, err)
+		}
+		roots[i] = c.String()
+	}
+
+	chunks := [][]string{nil}
+	if len(roots) > 0 {
+		chunks = chunks[:0]
+		for len(roots) > 0 {
+			n := min(f.BatchSize, len(roots))
+			chunks = append(chunks, roots[:n])
+			roots = roots[n:]
+		}
+	}
+
+	res := &DeleteResult{DryRun: f.DryRun}
+	for _, chunk := range chunks {
+		last := ""
+		for {
+			if err := ctx.Err(); err != nil {
+				return res, err
+			}
+
+			batch, err := s.bulkBatch(ctx, where, args, chunk, last, f.BatchSize)
+			if err != nil {
+				return res, err
+			}
+			if len(batch) == 0 {
+				break
+			}
+
+			if f.DryRun {
+				for _, e := range batch {
+					res.Roots++
+					res.Bytes += e.size
+				}
+			} else {
+				n, bytes, err := s.deleteRoots(ctx, batch)
+				if err != nil {
+					return res, err
+				}
+				res.Roots += n
+				res.Bytes += bytes
+			}
+
+			if len(batch) < f.BatchSize {
+				break
+			}
+			last = batch[len(batch)-1].root
+		}
+	}
+
+	log.Infow("bulk delete", "requestID", requestid.FromContext(ctx), "roots", res.Roots, "bytes", res.Bytes, "dryRun", res.DryRun)
+	return res, nil
+}
+
+// bulkBatch returns the next batch of matching roots after last, limited to
+// chunk when it is set.
+func (s *Server) bulkBatch(ctx context.Context, where []string, args []any, chunk []string, last string, limit int) ([]reapedRoot, error) {
+	where = append([]string(nil), where...)
+	args = append([]any(nil), args...)
+
+	if len(chunk) > 0 {
+		ph := make([]string, len(chunk))
+		for i, root := range chunk {
+			args = append(args, root)
+			ph[i] = fmt.Sprintf("$%d", len(args))
+		}
+		where = append(where, "root IN ("+strings.Join(ph, ", ")+")")
+	}
+	if last != "" {
+		args = append(args, last)
+		where = append(where, fmt.Sprintf("root > $%d", len(args)))
+	}
+	args = append(args, limit)
+
+	query := fmt.Sprintf(`SELECT root, size FROM RootBlocks WHERE %s ORDER BY root LIMIT $%d`, strings.Join(where, " AND "), len(args))
+
+	stop := s.d.Timer("bulk_batch")
+	defer stop()
+
+	rows, err := s.d.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []reapedRoot
+	for rows.Next() {
+		var e reapedRoot
+		if err := rows.Scan(&e.root, &e.size); err != nil {
+			return nil, err
+		}
+		batch = append(batch, e)
+	}
+
+	return batch, rows.Err()
+}
+
+// deleteRoots marks the batch as deleted in every namespace in one
+// transaction, roots deleted since they were selected are skipped.
+func (s *Server) deleteRoots(ctx context.Context, batch []reapedRoot) (int64, int64, error) {
+	var deleted, bytes int64
+
+	stop := s.d.Timer("bulk_delete")
+	err := s.withBlocksTx(ctx, func(tx *sql.Tx, bb db.BlockBatch) error {
+		deleted, bytes = 0, 0
+		now, actor := time.Now().UTC(), auth.IdentityFromContext(ctx)
+		for _, e := range batch {
+			ok, err := tombstone(ctx, tx, bb, now, actor, "", e.root)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if err := audit(ctx, tx, now, ActionDelete, "", e.root, actor, "bulk"); err != nil {
+				return err
+			}
+			deleted++
+			bytes += e.size
+		}
+		return nil
+	})
+	stop()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return deleted, bytes, nil
+}
+
+// bulkDeleteHandle deletes the roots matching the json DeleteFilter of the
+// request body.
+func (s *Server) bulkDeleteHandle(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.opts.MaxBodySize)
+
+	var f DeleteFilter
+	err := json.NewDecoder(r.Body).Decode(&f)
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	res, err := s.bulkDelete(r.Context(), &f)
+	if err != nil {
+		// without a result the filter was rejected before any batch ran
+		if res == nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Errorw("bulk delete", "requestID", requestid.FromContext(r.Context()), "roots", res.Roots, "bytes", res.Bytes, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
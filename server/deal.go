@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gh-efforts/retrieve-server/requestid"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// multihash of v2 piece cids (FRC-0069), missing from go-multicodec v0.9
+const fr32Sha256Trunc254Padbintree = 0x1011
+
+// Deal places a root in a Filecoin piece, every field but the piece cid is
+// optional.
+type Deal struct {
+	Root     string `json:"root,omitempty"`
+	PieceCid string `json:"piece_cid"`
+	DealID   *int64 `json:"deal_id,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	Sector   *int64 `json:"sector,omitempty"`
+	Offset   *int64 `json:"offset,omitempty"`
+}
+
+// parseDeal reads the deal of an upload from the piece_cid, deal_id,
+// provider, sector and offset query parameters, it returns nil when
+// piece_cid is not set.
+func parseDeal(r *http.Request) (*Deal, error) {
+	q := r.URL.Query()
+	piece := q.Get("piece_cid")
+	if piece == "" {
+		for _, k := range []string{"deal_id", "provider", "sector", "offset"} {
+			if q.Has(k) {
+				return nil, fmt.Errorf("%s requires piece_cid", k)
+			}
+		}
+		return nil, nil
+	}
+
+	c, err := parsePieceCid(piece)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Deal{
+		PieceCid: c.String(),
+		Provider: q.Get("provider"),
+	}
+	for k, p := range map[string]**int64{"deal_id": &d.DealID, "sector": &d.Sector, "offset": &d.Offset} {
+		v := q.Get(k)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %s: %s", k, v)
+		}
+		*p = &n
+	}
+
+	return d, nil
+}
+
+// parsePieceCid accepts v1 (fil-commitment-unsealed) and v2 piece cids.
+func parsePieceCid(s string) (cid.Cid, error) {
+	c, err := cid.Parse(s)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("invalid piece cid: %w", err)
+	}
+
+	prefix := c.Prefix()
+	switch {
+	case prefix.Codec == uint64(multicodec.FilCommitmentUnsealed) && prefix.MhType == uint64(multicodec.Sha2_256Trunc254Padded):
+	case prefix.Codec == uint64(multicodec.Raw) && prefix.MhType == fr32Sha256Trunc254Padbintree:
+	default:
+		return cid.Undef, fmt.Errorf("not a piece cid: %s", s)
+	}
+
+	return c, nil
+}
+
+func (s *Server) addDeal(ctx context.Context, tx *sql.Tx, root string, d *Deal) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO RootDeals(root, piece_cid, deal_id, provider, sector, piece_offset)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (root, piece_cid) DO UPDATE SET deal_id = $3, provider = $4, sector = $5, piece_offset = $6`,
+		root, d.PieceCid, d.DealID, d.Provider, d.Sector, d.Offset)
+	return err
+}
+
+// pieceRoots returns the deals of the roots of ns stored with piece,
+// deleted roots are left out.
+func (s *Server) pieceRoots(ctx context.Context, ns string, piece string) ([]Deal, error) {
+	ctx, span := s.startSpan(ctx, "piece_roots", "")
+	span.SetAttributes(attribute.String("piece_cid", piece))
+	stop := s.d.Timer("piece_roots")
+	deals, err := s.queryDeals(ctx, `SELECT d.root, d.piece_cid, d.deal_id, d.provider, d.sector, d.piece_offset FROM RootDeals d
+		JOIN NamespaceRoots n ON n.root = d.root JOIN RootBlocks b ON b.root = d.root
+		WHERE n.ns=$1 AND n.deleted_at IS NULL AND d.piece_cid=$2 AND b.deleted_at IS NULL ORDER BY d.root`, ns, piece)
+	stop()
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugw("piece_roots", "requestID", requestid.FromContext(ctx), "ns", ns, "piece", piece, "roots", len(deals))
+	return deals, nil
+}
+
+func (s *Server) queryDeals(ctx context.Context, query string, args ...any) ([]Deal, error) {
+	rows, err := s.d.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deals []Deal
+	for rows.Next() {
+		var d Deal
+		var dealID, sector, offset sql.NullInt64
+		if err := rows.Scan(&d.Root, &d.PieceCid, &dealID, &d.Provider, &sector, &offset); err != nil {
+			return nil, err
+		}
+		d.DealID = nullInt(dealID)
+		d.Sector = nullInt(sector)
+		d.Offset = nullInt(offset)
+		deals = append(deals, d)
+	}
+
+	return deals, rows.Err()
+}
+
+func nullInt(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+// pieceRootsHandle lists the payload roots of the namespace stored with a
+// piece cid.
+func (s *Server) pieceRootsHandle(w http.ResponseWriter, r *http.Request) {
+	ns, err := namespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c, err := parsePieceCid(r.PathValue("pieceCid"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deals, err := s.pieceRoots(r.Context(), ns, c.String())
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	if len(deals) == 0 {
+		http.Error(w, "no roots stored for piece", http.StatusNotFound)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(deals)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
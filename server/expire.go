@@ -0,0 +1,451 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gh-efforts/retrieve-server/db"
+	"github.com/gh-efforts/retrieve-server/metrics"
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+type ReaperOptions struct {
+	// Interval between runs, zero disables the reaper.
+	Interval time.Duration
+	// BatchSize is the number of roots deleted per transaction.
+	BatchSize int
+	// ArchiveDir receives one car file per batch holding the expired roots
+	// no namespace serves anymore, written before they are deleted and kept
+	// once the deletion committed. Empty deletes without archiving.
+	ArchiveDir string
+	// PurgeDelay is how long deleted roots can be undeleted before the
+	// reaper removes them for good.
+	PurgeDelay time.Duration
+}
+
+// reapKind selects the rows a reaper pass deletes, query selects the ns,
+// root, size and, in place of %s, the block of up to $2 rows matching the
+// cutoff $1.
+type reapKind struct {
+	reason  string
+	action  string
+	query   string
+	archive bool
+}
+
+var (
+	// roots expire from each namespace on their own
+	reapExpired = reapKind{
+		reason: "expired",
+		action: ActionExpire,
+		query: `SELECT n.ns, n.root, b.size, %s FROM NamespaceRoots n JOIN RootBlocks b ON b.root = n.root
+			WHERE n.expires_at <= $1 AND n.deleted_at IS NULL ORDER BY n.ns, n.root LIMIT $2`,
+		archive: true,
+	}
+	reapPurged = reapKind{
+		reason: "purged",
+		action: ActionPurge,
+		query:  `SELECT '', root, size, %s FROM RootBlocks WHERE deleted_at <= $1 ORDER BY root LIMIT $2`,
+	}
+)
+
+// RunReaper expires roots from namespaces and purges deleted roots on start
+// and then every interval until ctx is done.
+func (s *Server) RunReaper(ctx context.Context, opts ReaperOptions) {
+	if opts.Interval <= 0 {
+		return
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		s.reapOnce(ctx, time.Now().UTC(), opts)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reapOnce runs every reaper pass once.
+func (s *Server) reapOnce(ctx context.Context, now time.Time, opts ReaperOptions) {
+	for _, pass := range []struct {
+		kind   reapKind
+		cutoff time.Time
+	}{
+		{reapExpired, now},
+		{reapPurged, now.Add(-opts.PurgeDelay)},
+	} {
+		n, err := s.reap(ctx, pass.kind, pass.cutoff, opts)
+		if err != nil {
+			log.Errorw("reap roots", "reason", pass.kind.reason, "deleted", n, "err", err)
+			continue
+		}
+		if n > 0 {
+			log.Infow("reaped roots", "reason", pass.kind.reason, "deleted", n)
+		}
+	}
+
+	n, err := s.purgeNamespaceRoots(ctx, now.Add(-opts.PurgeDelay), opts.BatchSize)
+	if err != nil {
+		log.Errorw("purge namespace roots", "deleted", n, "err", err)
+	} else if n > 0 {
+		log.Infow("purged namespace roots", "deleted", n)
+	}
+}
+
+// purgeNamespaceRoots removes roots deleted from a namespace before cutoff
+// whose block other namespaces still hold.
+func (s *Server) purgeNamespaceRoots(ctx context.Context, cutoff time.Time, batchSize int) (int, error) {
+	type nsRoot struct{ ns, root string }
+
+	total := 0
+	for ctx.Err() == nil {
+		var batch []nsRoot
+		err := func() error {
+			rows, err := s.d.DB.QueryContext(ctx, `SELECT ns, root FROM NamespaceRoots WHERE deleted_at <= $1 ORDER BY ns, root LIMIT $2`, cutoff, batchSize)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var e nsRoot
+				if err := rows.Scan(&e.ns, &e.root); err != nil {
+					return err
+				}
+				batch = append(batch, e)
+			}
+			return rows.Err()
+		}()
+		if err != nil || len(batch) == 0 {
+			return total, err
+		}
+
+		deleted := 0
+		stop := s.d.Timer("reap_ns_delete")
+		err = s.withTx(ctx, func(tx *sql.Tx) error {
+			deleted = 0
+			now := time.Now().UTC()
+			for _, e := range batch {
+				res, err := tx.ExecContext(ctx, `DELETE FROM NamespaceRoots WHERE deleted_at <= $1 AND ns=$2 AND root=$3`, cutoff, e.ns, e.root)
+				if err != nil {
+					return err
+				}
+				if n, _ := res.RowsAffected(); n == 0 {
+					continue
+				}
+				if err := audit(ctx, tx, now, ActionPurge, e.ns, e.root, "reaper", ""); err != nil {
+					return err
+				}
+				deleted++
+			}
+			return nil
+		})
+		stop()
+		if err != nil {
+			return total, err
+		}
+		total += deleted
+
+		if len(batch) < batchSize {
+			break
+		}
+	}
+
+	return total, ctx.Err()
+}
+
+// reap deletes the rows selected by kind in batches and returns how many
+// were deleted.
+func (s *Server) reap(ctx context.Context, kind reapKind, cutoff time.Time, opts ReaperOptions) (int, error) {
+	archiveDir := ""
+	if kind.archive {
+		archiveDir = opts.ArchiveDir
+	}
+
+	total := 0
+	for ctx.Err() == nil {
+		batch, err := s.reapBatch(ctx, kind, cutoff, opts.BatchSize, archiveDir != "")
+		if err != nil {
+			return total, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		n, err := s.deleteBatch(ctx, kind, cutoff, batch, archiveDir)
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		if len(batch) < opts.BatchSize {
+			break
+		}
+	}
+
+	return total, ctx.Err()
+}
+
+// reapedRoot is a root to delete, ns is the namespace it expired from and
+// empty for a root purged from all of them.
+type reapedRoot struct {
+	ns    string
+	root  string
+	size  int64
+	block []byte
+}
+
+// reapBatch returns up to limit rows selected by kind, blocks are only read
+// when they are archived.
+func (s *Server) reapBatch(ctx context.Context, kind reapKind, cutoff time.Time, limit int, withBlocks bool) ([]reapedRoot, error) {
+	block := "NULL"
+	if withBlocks {
+		block = "block"
+	}
+	query := fmt.Sprintf(kind.query, block)
+
+	stop := s.d.Timer("reap_batch")
+	defer stop()
+
+	rows, err := s.d.DB.QueryContext(ctx, query, cutoff, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []reapedRoot
+	for rows.Next() {
+		var e reapedRoot
+		if err := rows.Scan(&e.ns, &e.root, &e.size, &e.block); err != nil {
+			return nil, err
+		}
+		if withBlocks && s.d.Blocks != nil {
+			if e.block, err = s.d.Blocks.Raw(e.root); err != nil {
+				return nil, fmt.Errorf("block of %s: %w", e.root, err)
+			}
+		}
+		batch = append(batch, e)
+	}
+
+	return batch, rows.Err()
+}
+
+// deleteBatch deletes the batch in one transaction, rows that no longer
+// match kind since they were selected, e.g. uploaded again, are kept. With
+// an archive dir the roots no namespace serves afterwards are written to a
+// car file inside the transaction, which is only kept once it committed.
+func (s *Server) deleteBatch(ctx context.Context, kind reapKind, cutoff time.Time, batch []reapedRoot, archiveDir string) (int, error) {
+	var deleted, bytes int64
+	var gone []reapedRoot
+	var tmp string
+
+	stop := s.d.Timer("reap_delete")
+	err := s.withBlocksTx(ctx, func(tx *sql.Tx, bb db.BlockBatch) error {
+		now := time.Now().UTC()
+		for _, e := range batch {
+			var outcome expiry
+			var err error
+			if e.ns != "" {
+				outcome, err = expireNamespaceRoot(ctx, tx, bb, now, cutoff, e)
+			} else {
+				var ok bool
+				ok, err = purgeRoot(ctx, tx, bb, cutoff, e.root)
+				if ok {
+					outcome = expiryRemoved
+				}
+			}
+			if err != nil {
+				return err
+			}
+			if outcome == expirySkipped {
+				continue
+			}
+			if err := audit(ctx, tx, now, kind.action, e.ns, e.root, "reaper", ""); err != nil {
+				return err
+			}
+			deleted++
+			if outcome == expiryRemoved {
+				bytes += e.size
+			}
+			if outcome != expiryShared {
+				gone = append(gone, e)
+			}
+		}
+
+		if archiveDir == "" || len(gone) == 0 {
+			return nil
+		}
+		var err error
+		tmp, err = archive(ctx, archiveDir, gone)
+		if err != nil {
+			return fmt.Errorf("archive: %w", err)
+		}
+		return nil
+	})
+	stop()
+	if err != nil {
+		if tmp != "" {
+			os.Remove(tmp)
+		}
+		return 0, err
+	}
+
+	recordDeleted(kind.reason, deleted, bytes)
+
+	if tmp != "" {
+		path := strings.TrimSuffix(tmp, ".tmp")
+		if err := os.Rename(tmp, path); err != nil {
+			return int(deleted), fmt.Errorf("archive: %w", err)
+		}
+		log.Infow("archived expired roots", "path", path, "roots", len(gone))
+		stats.Record(ctx, metrics.ArchivedRoots.M(int64(len(gone))))
+	}
+
+	return int(deleted), nil
+}
+
+// expiry is what expiring a root from a namespace did.
+type expiry int
+
+const (
+	// the expiry moved since the root was selected
+	expirySkipped expiry = iota
+	// another namespace still serves the block
+	expiryShared
+	// only deleted namespaces hold the block, it is tombstoned
+	expiryTombstoned
+	// the block was removed
+	expiryRemoved
+)
+
+// expireNamespaceRoot removes root from the namespace it expired from
+// unless the expiry moved since it was selected. The block stays while
+// another namespace serves it, when only deleted namespaces are left it is
+// tombstoned so they can still undelete it, otherwise it is removed.
+func expireNamespaceRoot(ctx context.Context, tx *sql.Tx, bb db.BlockBatch, now, cutoff time.Time, e reapedRoot) (expiry, error) {
+	res, err := tx.ExecContext(ctx, `DELETE FROM NamespaceRoots WHERE expires_at <= $1 AND deleted_at IS NULL AND ns=$2 AND root=$3`, cutoff, e.ns, e.root)
+	if err != nil {
+		return expirySkipped, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return expirySkipped, nil
+	}
+	if err := bb.Hide(e.ns, e.root); err != nil {
+		return expirySkipped, err
+	}
+
+	var live, held int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) - COUNT(deleted_at), COUNT(*) FROM NamespaceRoots WHERE root=$1`, e.root).Scan(&live, &held)
+	if err != nil {
+		return expirySkipped, err
+	}
+
+	switch {
+	case live > 0:
+		return expiryShared, nil
+	case held > 0:
+		_, err = tx.ExecContext(ctx, `UPDATE RootBlocks SET deleted_at=$1, deleted_by='reaper' WHERE root=$2 AND deleted_at IS NULL`, now, e.root)
+		return expiryTombstoned, err
+	}
+
+	if _, err := purgeRoot(ctx, tx, bb, time.Time{}, e.root); err != nil {
+		return expirySkipped, err
+	}
+	return expiryRemoved, nil
+}
+
+// purgeRoot removes root, its deals and what is left of its namespaces,
+// a zero cutoff removes it whether it was deleted or not.
+func purgeRoot(ctx context.Context, tx *sql.Tx, bb db.BlockBatch, cutoff time.Time, root string) (bool, error) {
+	query, args := `DELETE FROM RootBlocks WHERE root=$1`, []any{root}
+	if !cutoff.IsZero() {
+		query, args = `DELETE FROM RootBlocks WHERE root=$1 AND deleted_at <= $2`, []any{root, cutoff}
+	}
+
+	res, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if err := bb.Remove(root); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM RootDeals WHERE root=$1`, root); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM NamespaceRoots WHERE root=$1`, root); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// archive writes the batch to a new car file in dir, the expired roots are
+// the roots of the car. It returns the path of the file, which ends in .tmp
+// until the deletion of the batch committed.
+func archive(ctx context.Context, dir string, batch []reapedRoot) (string, error) {
+	roots := make([]cid.Cid, 0, len(batch))
+	for _, e := range batch {
+		c, err := cid.Parse(e.root)
+		if err != nil {
+			return "", err
+		}
+		roots = append(roots, c)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("expired-%d.car.tmp", time.Now().UnixNano()))
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	err = func() error {
+		car, err := storage.NewWritable(f, roots, carv2.WriteAsCarV1(true))
+		if err != nil {
+			return err
+		}
+		for i, e := range batch {
+			if err := car.Put(ctx, roots[i].KeyString(), e.block); err != nil {
+				return err
+			}
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		return f.Close()
+	}()
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+
+	return path, nil
+}
+
+func recordDeleted(reason string, roots int64, bytes int64) {
+	ctx, _ := tag.New(context.Background(), tag.Upsert(metrics.Reason, reason))
+	stats.Record(ctx, metrics.DeletedRoots.M(roots), metrics.DeletedBytes.M(bytes))
+}
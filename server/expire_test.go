@@ -0,0 +1,414 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	carv2 "github.com/ipld/go-car/v2"
+)
+
+func TestParseUploadExpiry(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    time.Duration
+		at      string
+		wantErr bool
+	}{
+		{name: "no expiry"},
+		{name: "ttl", query: "ttl=2h", want: 2 * time.Hour},
+		{name: "expires_at", query: "expires_at=2030-01-02T03:04:05%2B02:00", at: "2030-01-02T01:04:05Z"},
+		{name: "ttl and expires_at", query: "ttl=2h&expires_at=2030-01-02T03:04:05Z", wantErr: true},
+		{name: "invalid ttl", query: "ttl=soon", wantErr: true},
+		{name: "negative ttl", query: "ttl=-1h", wantErr: true},
+		{name: "invalid expires_at", query: "expires_at=2030-01-02", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/block?"+tt.query, nil)
+			up, err := parseUpload(r, SourcePost)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			switch {
+			case tt.want != 0:
+				if up.expiresAt == nil || time.Until(*up.expiresAt) > tt.want || time.Until(*up.expiresAt) < tt.want-time.Minute {
+					t.Fatalf("expires at %v, want in %s", up.expiresAt, tt.want)
+				}
+			case tt.at != "":
+				if up.expiresAt == nil || up.expiresAt.Format(time.RFC3339) != tt.at {
+					t.Fatalf("expires at %v, want %s", up.expiresAt, tt.at)
+				}
+			case up.expiresAt != nil:
+				t.Fatalf("expires at %v, want no expiry", up.expiresAt)
+			}
+		})
+	}
+}
+
+func TestReap(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name       string
+		expired    int
+		live       int
+		deleted    int
+		purgeDelay time.Duration
+		archive    bool
+		// roots left afterwards, deleted ones included
+		want int
+	}{
+		{name: "expired roots are removed in batches", expired: 5, live: 2, want: 2},
+		{name: "expired roots are archived", expired: 3, live: 1, archive: true, want: 1},
+		{name: "deleted roots are purged after the delay", deleted: 3, live: 1, want: 1},
+		{name: "deleted roots are kept during the delay", deleted: 3, live: 1, purgeDelay: time.Hour, want: 4},
+	}
+
+	for _, backend := range backends {
+		for _, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				s := openTestServer(t, testDBPath(t, backend), Options{})
+				ctx := context.Background()
+
+				var expired []string
+				for i := 0; i < tt.expired+tt.live+tt.deleted; i++ {
+					rb := testBlock(t, tt.name+strconv.Itoa(i))
+					up := &upload{source: SourcePost}
+					if i < tt.expired {
+						up.expiresAt = &past
+						expired = append(expired, rb.Root)
+					}
+					if err := s.upsert(ctx, DefaultNamespace, rb, up); err != nil {
+						t.Fatal(err)
+					}
+					if i >= tt.expired+tt.live {
+						if err := s.delete(ctx, DefaultNamespace, rb.Root); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+
+				opts := ReaperOptions{BatchSize: 2, PurgeDelay: tt.purgeDelay}
+				if tt.archive {
+					opts.ArchiveDir = t.TempDir()
+				}
+				s.reapOnce(ctx, time.Now().UTC(), opts)
+
+				var n int
+				if err := s.d.DB.QueryRow(`SELECT COUNT(*) FROM RootBlocks`).Scan(&n); err != nil {
+					t.Fatal(err)
+				}
+				if n != tt.want {
+					t.Fatalf("%d roots left, want %d", n, tt.want)
+				}
+
+				if tt.archive {
+					slices.Sort(expired)
+					if archived := archivedRoots(t, opts.ArchiveDir); !slices.Equal(archived, expired) {
+						t.Fatalf("archived %v, want %v", archived, expired)
+					}
+				}
+			})
+		}
+	}
+}
+
+// archivedRoots reads the roots of the car files in dir and checks their
+// blocks are in them.
+func archivedRoots(t *testing.T, dir string) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "expired-*.car"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var roots []string
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		br, err := carv2.NewBlockReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks := 0
+		for {
+			if _, err := br.Next(); err != nil {
+				break
+			}
+			blocks++
+		}
+		if blocks != len(br.Roots) {
+			t.Fatalf("%s holds %d blocks of %d roots", file, blocks, len(br.Roots))
+		}
+		for _, c := range br.Roots {
+			roots = append(roots, c.String())
+		}
+	}
+
+	slices.Sort(roots)
+	return roots
+}
+
+func TestReapNamespaces(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	type put struct {
+		ns        string
+		expiresAt *time.Time
+	}
+	tests := []struct {
+		name     string
+		puts     []put
+		deleteNS string
+		// namespaces serving the root after the reaper ran
+		serving []string
+		// tombstoned when only deleted namespaces still hold the root
+		tombstoned bool
+		// removed when no namespace holds the root anymore
+		removed bool
+	}{
+		{
+			name:    "root expires from its only namespace",
+			puts:    []put{{ns: "a", expiresAt: &past}},
+			removed: true,
+		},
+		{
+			name:    "expiry in the future is kept",
+			puts:    []put{{ns: "a", expiresAt: &future}},
+			serving: []string{"a"},
+		},
+		{
+			name:    "other namespaces keep serving the root",
+			puts:    []put{{ns: "a", expiresAt: &past}, {ns: "b"}, {ns: "c", expiresAt: &future}},
+			serving: []string{"b", "c"},
+		},
+		{
+			name:    "every namespace expiring removes the root",
+			puts:    []put{{ns: "a", expiresAt: &past}, {ns: "b", expiresAt: &past}},
+			removed: true,
+		},
+		{
+			name:       "deleted namespaces keep a tombstone",
+			puts:       []put{{ns: "a", expiresAt: &past}, {ns: "b"}},
+			deleteNS:   "b",
+			tombstoned: true,
+		},
+		{
+			name:    "upload without expiry keeps the one set",
+			puts:    []put{{ns: "a", expiresAt: &past}, {ns: "a"}},
+			removed: true,
+		},
+		{
+			name:    "upload with an expiry moves it",
+			puts:    []put{{ns: "a", expiresAt: &past}, {ns: "a", expiresAt: &future}},
+			serving: []string{"a"},
+		},
+	}
+
+	for _, backend := range backends {
+		for _, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				s := openTestServer(t, testDBPath(t, backend), Options{})
+				ctx := context.Background()
+				rb := testBlock(t, tt.name)
+
+				for _, p := range tt.puts {
+					if err := s.upsert(ctx, p.ns, rb, &upload{source: SourcePost, expiresAt: p.expiresAt}); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if tt.deleteNS != "" {
+					if err := s.delete(ctx, tt.deleteNS, rb.Root); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				s.reapOnce(ctx, time.Now().UTC(), ReaperOptions{BatchSize: 10, PurgeDelay: time.Hour})
+
+				for _, p := range tt.puts {
+					_, err := s.block(ctx, p.ns, rb.Root)
+					if serving := slices.Contains(tt.serving, p.ns); serving != (err == nil) {
+						t.Fatalf("namespace %s serves the root: %t, want %t (err %v)", p.ns, err == nil, serving, err)
+					}
+				}
+
+				m, err := s.meta(ctx, rb.Root)
+				if tt.removed {
+					if !errors.Is(err, sql.ErrNoRows) {
+						t.Fatalf("meta of a removed root: %v", err)
+					}
+					if s.d.Blocks != nil {
+						if _, err := s.d.Blocks.Raw(rb.Root); !errors.Is(err, sql.ErrNoRows) {
+							t.Fatalf("block of a removed root: %v", err)
+						}
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(m.Namespaces, tt.serving) {
+					t.Fatalf("namespaces %v, want %v", m.Namespaces, tt.serving)
+				}
+				if tombstoned := m.DeletedAt != nil; tombstoned != tt.tombstoned {
+					t.Fatalf("tombstoned %t, want %t", tombstoned, tt.tombstoned)
+				}
+
+				if tt.tombstoned {
+					if err := s.undelete(ctx, tt.deleteNS, rb.Root); err != nil {
+						t.Fatal(err)
+					}
+					if _, err := s.block(ctx, tt.deleteNS, rb.Root); err != nil {
+						t.Fatalf("block after undelete: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestReapArchive(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+
+	type put struct {
+		ns      string
+		data    string
+		expired bool
+	}
+	tests := []struct {
+		name string
+		puts []put
+		// the first reap fails and must leave no archive behind
+		failFirst bool
+		// roots in the archive, by data
+		want []string
+	}{
+		{
+			name: "roots no namespace holds are archived",
+			puts: []put{{ns: "a", data: "x", expired: true}, {ns: "a", data: "y"}},
+			want: []string{"x"},
+		},
+		{
+			name: "roots another namespace holds are not archived",
+			puts: []put{{ns: "a", data: "x", expired: true}, {ns: "b", data: "x"}},
+		},
+		{
+			name: "shared roots are archived once their last namespace expires",
+			puts: []put{{ns: "a", data: "x", expired: true}, {ns: "b", data: "x", expired: true}},
+			want: []string{"x"},
+		},
+		{
+			name:      "a failed delete archives nothing and the retry archives once",
+			puts:      []put{{ns: "a", data: "x", expired: true}},
+			failFirst: true,
+			want:      []string{"x"},
+		},
+	}
+
+	for _, backend := range backends {
+		for _, tt := range tests {
+			t.Run(backend+"/"+tt.name, func(t *testing.T) {
+				s := openTestServer(t, testDBPath(t, backend), Options{})
+				ctx := context.Background()
+
+				for _, p := range tt.puts {
+					up := &upload{source: SourcePost}
+					if p.expired {
+						up.expiresAt = &past
+					}
+					if err := s.upsert(ctx, p.ns, testBlock(t, p.data), up); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				opts := ReaperOptions{BatchSize: 10, ArchiveDir: t.TempDir()}
+
+				if tt.failFirst {
+					// the audit insert fails, rolling the delete back
+					if _, err := s.d.DB.Exec(`ALTER TABLE AuditLog RENAME TO AuditLogOff`); err != nil {
+						t.Fatal(err)
+					}
+					s.reapOnce(ctx, time.Now().UTC(), opts)
+					if _, err := s.d.DB.Exec(`ALTER TABLE AuditLogOff RENAME TO AuditLog`); err != nil {
+						t.Fatal(err)
+					}
+
+					if entries, err := os.ReadDir(opts.ArchiveDir); err != nil || len(entries) != 0 {
+						t.Fatalf("archive dir after a failed delete: %v %v", entries, err)
+					}
+					if _, err := s.block(ctx, tt.puts[0].ns, testBlock(t, tt.puts[0].data).Root); err != nil {
+						t.Fatalf("block after a failed delete: %v", err)
+					}
+				}
+
+				// a second run finds nothing left to archive
+				s.reapOnce(ctx, time.Now().UTC(), opts)
+				s.reapOnce(ctx, time.Now().UTC(), opts)
+
+				var want []string
+				for _, data := range tt.want {
+					want = append(want, testBlock(t, data).Root)
+				}
+				slices.Sort(want)
+				if archived := archivedRoots(t, opts.ArchiveDir); !slices.Equal(archived, want) {
+					t.Fatalf("archived %v, want %v", archived, want)
+				}
+			})
+		}
+	}
+}
+
+func TestRunReaperStarts(t *testing.T) {
+	s := newTestServer(t, Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	past := time.Now().Add(-time.Hour)
+	rb := testBlock(t, "expired")
+	if err := s.upsert(ctx, DefaultNamespace, rb, &upload{source: SourcePost, expiresAt: &past}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.RunReaper(ctx, ReaperOptions{Interval: time.Hour})
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := s.meta(ctx, rb.Root); errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the reaper did not run on start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+}
@@ -1,14 +1,27 @@
 package server
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"time"
 
 	"github.com/gh-efforts/retrieve-server/middleware"
 	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// sections of a car stream are a cid followed by the block data
+const maxCidLen = 128
+
+var errBlockTooLarge = errors.New("block too large")
+
 type RootBlock struct {
 	Root  string `json:"root"`
 	Block []byte `json:"block"`
@@ -19,28 +32,205 @@ type RootSize struct {
 	Size int    `json:"size"`
 }
 
-func (s *Server) Handle() {
-	http.HandleFunc("POST /block", middleware.Timer(s.upsertHandle, "upsert"))
-	http.HandleFunc("GET /block/{root}", middleware.Timer(s.blockHandle, "block"))
-	http.HandleFunc("GET /size/{root}", middleware.Timer(s.sizeHandle, "size"))
-	http.HandleFunc("DELETE /block/{root}", middleware.Timer(s.deleteHandle, "delete"))
+// RootMeta records when, how and by whom a root was stored, the times are
+// unset for roots stored before the metadata was recorded. Deleted roots
+// keep their metadata until they are purged. ExpiresAt is when the root
+// expires from the last namespace holding it.
+type RootMeta struct {
+	Root       string     `json:"root"`
+	Size       int        `json:"size"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	DeletedAt  *time.Time `json:"deleted_at,omitempty"`
+	DeletedBy  string     `json:"deleted_by,omitempty"`
+	Uploader   string     `json:"uploader"`
+	Source     string     `json:"source"`
+	Codec      string     `json:"codec"`
+	Multihash  string     `json:"multihash"`
+	Namespaces []string   `json:"namespaces,omitempty"`
+	Deals      []Deal     `json:"deals,omitempty"`
+}
+
+// Handle registers the block api of the default namespace and, under a
+// /ns/{ns} prefix, of every other namespace.
+func (s *Server) Handle(mux *http.ServeMux) {
+	for _, prefix := range []string{"", "/ns/{ns}"} {
+		mux.Handle("POST "+prefix+"/block", middleware.Handler(s.upsertHandle, "upsert"))
+		mux.Handle("PUT "+prefix+"/block/{root}", middleware.Handler(s.putRawHandle, "put_raw"))
+		mux.Handle("POST "+prefix+"/car", middleware.Handler(s.carHandle, "car"))
+		mux.Handle("GET "+prefix+"/block/{root}", middleware.Handler(s.blockHandle, "block"))
+		mux.Handle("GET "+prefix+"/size/{root}", middleware.Handler(s.sizeHandle, "size"))
+		mux.Handle("GET "+prefix+"/piece/{pieceCid}/roots", middleware.Handler(s.pieceRootsHandle, "piece_roots"))
+		mux.Handle("DELETE "+prefix+"/block/{root}", middleware.Handler(s.deleteHandle, "delete"))
+	}
+	mux.Handle("GET /meta/{root}", middleware.Handler(s.metaHandle, "meta"))
+	mux.Handle("GET /ns/{ns}/roots", middleware.Handler(s.rootsHandle, "ns_roots"))
+	mux.Handle("GET /ns/{ns}/stats", middleware.Handler(s.statsHandle, "ns_stats"))
 }
 
 func (s *Server) upsertHandle(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.opts.MaxBodySize)
+
+	ns, err := namespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var rb RootBlock
-	err := json.NewDecoder(r.Body).Decode(&rb)
+	err = json.NewDecoder(r.Body).Decode(&rb)
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	up, err := parseUpload(r, SourcePost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = verify(r.Context(), &rb, s.opts.MaxBlockSize)
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	err = s.upsert(r.Context(), ns, &rb, up)
+	if err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err))
+		return
+	}
+}
+
+// putRawHandle stores the request body as the block of root, the body is
+// read up to the block size limit instead of being decoded from json.
+func (s *Server) putRawHandle(w http.ResponseWriter, r *http.Request) {
+	ns, err := namespace(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = verify(&rb)
+	block, err := io.ReadAll(io.LimitReader(r.Body, s.opts.MaxBlockSize+1))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = s.upsert(&rb)
+	rb := RootBlock{
+		Root:  r.PathValue("root"),
+		Block: block,
+	}
+
+	up, err := parseUpload(r, SourcePost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = verify(r.Context(), &rb, s.opts.MaxBlockSize)
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	err = s.upsert(r.Context(), ns, &rb, up)
+	if err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err))
+		return
+	}
+}
+
+// carHandle reads a car stream and stores the blocks of its roots, the roots
+// are taken from the "root" query parameters or else from the car header.
+// Blocks are decoded one at a time and reading stops once all roots are
+// stored, the body is read up to the car size limit.
+func (s *Server) carHandle(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.opts.MaxCarSize)
+
+	ns, err := namespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	up, err := parseUpload(r, SourceCar)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	br, err := carv2.NewBlockReader(r.Body, carv2.MaxAllowedSectionSize(uint64(s.opts.MaxBlockSize+maxCidLen)))
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	roots := br.Roots
+	if q := r.URL.Query()["root"]; len(q) > 0 {
+		roots = roots[:0:0]
+		for _, v := range q {
+			root, err := cid.Parse(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			roots = append(roots, root)
+		}
+	}
+	if len(roots) == 0 {
+		http.Error(w, "car has no roots, set them in its header or with root parameters", http.StatusBadRequest)
+		return
+	}
+
+	wanted := make(map[cid.Cid]struct{}, len(roots))
+	for _, root := range roots {
+		wanted[root] = struct{}{}
+	}
+
+	var stored []string
+	for len(wanted) > 0 {
+		blk, err := br.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), uploadErrorStatus(err))
+			return
+		}
+
+		if _, ok := wanted[blk.Cid()]; !ok {
+			continue
+		}
+		delete(wanted, blk.Cid())
+
+		rb := RootBlock{
+			Root:  blk.Cid().String(),
+			Block: blk.RawData(),
+		}
+		if err := verify(r.Context(), &rb, s.opts.MaxBlockSize); err != nil {
+			http.Error(w, err.Error(), uploadErrorStatus(err))
+			return
+		}
+		if err := s.upsert(r.Context(), ns, &rb, up); err != nil {
+			http.Error(w, err.Error(), storeErrorStatus(err))
+			return
+		}
+		stored = append(stored, rb.Root)
+	}
+
+	if len(wanted) > 0 {
+		missing := make([]string, 0, len(wanted))
+		for root := range wanted {
+			missing = append(missing, root.String())
+		}
+		http.Error(w, fmt.Sprintf("roots not found in car: %v", missing), http.StatusBadRequest)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(stored)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -48,10 +238,16 @@ func (s *Server) upsertHandle(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) blockHandle(w http.ResponseWriter, r *http.Request) {
+	ns, err := namespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	root := r.PathValue("root")
-	block, err := s.block(root)
+	block, err := s.block(r.Context(), ns, root)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
@@ -68,10 +264,16 @@ func (s *Server) blockHandle(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) sizeHandle(w http.ResponseWriter, r *http.Request) {
+	ns, err := namespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	root := r.PathValue("root")
-	size, err := s.size(root)
+	size, err := s.size(r.Context(), ns, root)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), errorStatus(err))
 		return
 	}
 
@@ -88,15 +290,127 @@ func (s *Server) sizeHandle(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func (s *Server) metaHandle(w http.ResponseWriter, r *http.Request) {
+	m, err := s.meta(r.Context(), r.PathValue("root"))
+	if err != nil {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 func (s *Server) deleteHandle(w http.ResponseWriter, r *http.Request) {
-	err := s.delete(r.PathValue("root"))
+	ns, err := namespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.delete(r.Context(), ns, r.PathValue("root"))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
-func verify(rb *RootBlock) error {
+// upload holds what an upload request records next to its blocks.
+type upload struct {
+	source    string
+	deal      *Deal
+	expiresAt *time.Time
+}
+
+// parseUpload reads the "source" query parameter, tools importing existing
+// data set it to tell their uploads apart from regular ones, the optional
+// deal of the upload and its expiry, given either as a "ttl" duration such
+// as 720h or as an RFC 3339 "expires_at" time.
+func parseUpload(r *http.Request, source string) (*upload, error) {
+	q := r.URL.Query()
+	switch s := q.Get("source"); s {
+	case "":
+	case SourcePost, SourceCar, SourceImport, SourceMigrate:
+		source = s
+	default:
+		return nil, fmt.Errorf("unknown source: %s", s)
+	}
+
+	deal, err := parseDeal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	up := &upload{source: source, deal: deal}
+
+	ttl, expiresAt := q.Get("ttl"), q.Get("expires_at")
+	switch {
+	case ttl != "" && expiresAt != "":
+		return nil, fmt.Errorf("set either ttl or expires_at")
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid ttl: %s", ttl)
+		}
+		t := time.Now().Add(d).UTC()
+		up.expiresAt = &t
+	case expiresAt != "":
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires_at: %w", err)
+		}
+		t = t.UTC()
+		up.expiresAt = &t
+	}
+
+	return up, nil
+}
+
+// errorStatus answers 404 for missing roots, so they can be told apart from
+// db failures.
+func errorStatus(err error) int {
+	if errors.Is(err, sql.ErrNoRows) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// storeErrorStatus answers 507 when the tenant is out of storage and 403
+// when it may not store more roots.
+func storeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errByteQuota):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, errRootQuota):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// uploadErrorStatus maps decode and verify errors to 413 for oversized input
+// and 400 for everything else.
+func uploadErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || errors.Is(err, errBlockTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func verify(ctx context.Context, rb *RootBlock, maxBlockSize int64) (err error) {
+	_, span := tracer.Start(ctx, "verify", trace.WithAttributes(
+		attribute.String("root", rb.Root),
+		attribute.Int("size", len(rb.Block)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	if int64(len(rb.Block)) > maxBlockSize {
+		return fmt.Errorf("%w: %d > %d", errBlockTooLarge, len(rb.Block), maxBlockSize)
+	}
+
 	root, err := cid.Parse(rb.Root)
 	if err != nil {
 		return err
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+)
+
+// testCar returns a car v1 of blocks with the header roots.
+func testCar(t *testing.T, roots []*RootBlock, blocks ...*RootBlock) []byte {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.car")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var rootCids []cid.Cid
+	for _, rb := range roots {
+		rootCids = append(rootCids, cid.MustParse(rb.Root))
+	}
+	car, err := storage.NewWritable(f, rootCids, carv2.WriteAsCarV1(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rb := range blocks {
+		if err := car.Put(context.Background(), cid.MustParse(rb.Root).KeyString(), rb.Block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := car.Finalize(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCarHandle(t *testing.T) {
+	a, b := testBlock(t, "a"), testBlock(t, "b")
+	f1, f2 := testBlock(t, string(bytes.Repeat([]byte("f"), 1024))), testBlock(t, string(bytes.Repeat([]byte("g"), 1024)))
+
+	tests := []struct {
+		name   string
+		car    []byte
+		query  string
+		status int
+		stored []*RootBlock
+	}{
+		{name: "header roots", car: testCar(t, []*RootBlock{a, b}, a, b), status: http.StatusOK, stored: []*RootBlock{a, b}},
+		{name: "root parameters", car: testCar(t, []*RootBlock{a, b}, a, b), query: "?root=" + b.Root, status: http.StatusOK, stored: []*RootBlock{b}},
+		{name: "root missing from the car", car: testCar(t, []*RootBlock{a, b}, a), status: http.StatusBadRequest},
+		{name: "no roots", car: testCar(t, nil, a), status: http.StatusBadRequest},
+		{name: "car over the size limit", car: testCar(t, []*RootBlock{a}, f1, f2, a), status: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Options{MaxCarSize: 2048})
+
+			w := httptest.NewRecorder()
+			s.carHandle(w, httptest.NewRequest("POST", "/car"+tt.query, bytes.NewReader(tt.car)))
+			if w.Code != tt.status {
+				t.Fatalf("status %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+
+			for _, rb := range tt.stored {
+				if _, err := s.size(context.Background(), DefaultNamespace, rb.Root); err != nil {
+					t.Fatalf("%s not stored: %v", rb.Root, err)
+				}
+			}
+		})
+	}
+}
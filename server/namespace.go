@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gh-efforts/retrieve-server/auth"
+	"github.com/gh-efforts/retrieve-server/db"
+	"github.com/gh-efforts/retrieve-server/requestid"
+)
+
+// DefaultNamespace holds the roots of the routes without a /ns/{ns} prefix
+// and every root stored before namespaces existed.
+const DefaultNamespace = "default"
+
+const defaultListLimit = 1000
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+// NamespaceStats counts the live roots of a namespace, blocks shared with
+// other namespaces count in each of them.
+type NamespaceStats struct {
+	Namespace string `json:"ns"`
+	Roots     int64  `json:"roots"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// namespace returns the namespace of the request path, the default one for
+// routes without a prefix.
+func namespace(r *http.Request) (string, error) {
+	ns := r.PathValue("ns")
+	if ns == "" {
+		return DefaultNamespace, nil
+	}
+	if !namespacePattern.MatchString(ns) {
+		return "", fmt.Errorf("invalid namespace: %s", ns)
+	}
+	return ns, nil
+}
+
+// tombstone marks root as deleted in ns, or in every namespace when ns is
+// empty. The block itself is marked deleted once no namespace holds it any
+// more. It reports whether anything was marked.
+func tombstone(ctx context.Context, tx *sql.Tx, bb db.BlockBatch, now time.Time, actor, ns, root string) (bool, error) {
+	if err := bb.Hide(ns, root); err != nil {
+		return false, err
+	}
+
+	if ns == "" {
+		if _, err := tx.ExecContext(ctx, `UPDATE NamespaceRoots SET deleted_at=$1 WHERE root=$2 AND deleted_at IS NULL`, now, root); err != nil {
+			return false, err
+		}
+		res, err := tx.ExecContext(ctx, `UPDATE RootBlocks SET deleted_at=$1, deleted_by=$2 WHERE root=$3 AND deleted_at IS NULL`, now, actor, root)
+		if err != nil {
+			return false, err
+		}
+		n, _ := res.RowsAffected()
+		return n > 0, nil
+	}
+
+	res, err := tx.ExecContext(ctx, `UPDATE NamespaceRoots SET deleted_at=$1 WHERE ns=$2 AND root=$3 AND deleted_at IS NULL`, now, ns, root)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE RootBlocks SET deleted_at=$1, deleted_by=$2 WHERE root=$3 AND deleted_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM NamespaceRoots WHERE root=$3 AND deleted_at IS NULL)`, now, actor, root)
+	return true, err
+}
+
+// namespaceRoots lists the live roots of ns ordered by root, starting after
+// the given root.
+func (s *Server) namespaceRoots(ctx context.Context, ns string, after string, limit int) ([]string, error) {
+	ctx, span := s.startSpan(ctx, "ns_roots", "")
+	stop := s.d.Timer("ns_roots")
+	defer stop()
+
+	rows, err := s.d.DB.QueryContext(ctx, `SELECT root FROM NamespaceRoots WHERE ns=$1 AND deleted_at IS NULL AND root > $2 ORDER BY root LIMIT $3`, ns, after, limit)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	roots := []string{}
+	for rows.Next() {
+		var root string
+		if err := rows.Scan(&root); err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	err = rows.Err()
+	endSpan(span, err)
+
+	return roots, err
+}
+
+// namespaceStats returns the stats of ns, or of every namespace holding
+// live roots when ns is empty.
+func (s *Server) namespaceStats(ctx context.Context, ns string) ([]NamespaceStats, error) {
+	query := `SELECT n.ns, COUNT(*), COALESCE(SUM(b.size), 0) FROM NamespaceRoots n JOIN RootBlocks b ON b.root = n.root
+		WHERE n.deleted_at IS NULL AND b.deleted_at IS NULL`
+	var args []any
+	if ns != "" {
+		query += ` AND n.ns = $1`
+		args = append(args, ns)
+	}
+	query += ` GROUP BY n.ns ORDER BY n.ns`
+
+	ctx, span := s.startSpan(ctx, "ns_stats", "")
+	stop := s.d.Timer("ns_stats")
+	defer stop()
+
+	rows, err := s.d.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []NamespaceStats{}
+	for rows.Next() {
+		var st NamespaceStats
+		if err := rows.Scan(&st.Namespace, &st.Roots, &st.Bytes); err != nil {
+			endSpan(span, err)
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	err = rows.Err()
+	endSpan(span, err)
+
+	return stats, err
+}
+
+// deleteNamespace deletes every root of ns like delete does, one batch per
+// transaction. Blocks other namespaces hold are kept.
+func (s *Server) deleteNamespace(ctx context.Context, ns string, batchSize int) (*DeleteResult, error) {
+	res := &DeleteResult{}
+	for ctx.Err() == nil {
+		batch, err := s.namespaceBatch(ctx, ns, batchSize)
+		if err != nil {
+			return res, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		stop := s.d.Timer("ns_delete")
+		var deleted, bytes int64
+		err = s.withBlocksTx(ctx, func(tx *sql.Tx, bb db.BlockBatch) error {
+			deleted, bytes = 0, 0
+			now, actor := time.Now().UTC(), auth.IdentityFromContext(ctx)
+			for _, e := range batch {
+				ok, err := tombstone(ctx, tx, bb, now, actor, ns, e.root)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					continue
+				}
+				if err := audit(ctx, tx, now, ActionDelete, ns, e.root, actor, "namespace"); err != nil {
+					return err
+				}
+				deleted++
+				bytes += e.size
+			}
+			return nil
+		})
+		stop()
+		if err != nil {
+			return res, err
+		}
+		res.Roots += deleted
+		res.Bytes += bytes
+
+		if len(batch) < batchSize {
+			break
+		}
+	}
+
+	log.Infow("delete namespace", "requestID", requestid.FromContext(ctx), "ns", ns, "roots", res.Roots, "bytes", res.Bytes)
+	return res, ctx.Err()
+}
+
+// namespaceBatch returns up to limit live roots of ns, deleted roots drop
+// out of it so every call returns the next batch.
+func (s *Server) namespaceBatch(ctx context.Context, ns string, limit int) ([]reapedRoot, error) {
+	stop := s.d.Timer("ns_batch")
+	defer stop()
+
+	rows, err := s.d.DB.QueryContext(ctx, `SELECT n.root, b.size FROM NamespaceRoots n JOIN RootBlocks b ON b.root = n.root
+		WHERE n.ns=$1 AND n.deleted_at IS NULL ORDER BY n.root LIMIT $2`, ns, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []reapedRoot
+	for rows.Next() {
+		var e reapedRoot
+		if err := rows.Scan(&e.root, &e.size); err != nil {
+			return nil, err
+		}
+		batch = append(batch, e)
+	}
+
+	return batch, rows.Err()
+}
+
+// rootsHandle lists the roots of the namespace, "after" continues a listing
+// from the last root of the previous page.
+func (s *Server) rootsHandle(w http.ResponseWriter, r *http.Request) {
+	ns, err := namespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit: %s", v), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	roots, err := s.namespaceRoots(r.Context(), ns, r.URL.Query().Get("after"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(roots)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) statsHandle(w http.ResponseWriter, r *http.Request) {
+	ns, err := namespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := s.namespaceStats(r.Context(), ns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	st := NamespaceStats{Namespace: ns}
+	if len(stats) > 0 {
+		st = stats[0]
+	}
+
+	err = json.NewEncoder(w).Encode(st)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// namespacesHandle lists the stats of every namespace holding live roots.
+func (s *Server) namespacesHandle(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.namespaceStats(r.Context(), "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) deleteNamespaceHandle(w http.ResponseWriter, r *http.Request) {
+	ns, err := namespace(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.deleteNamespace(r.Context(), ns, defaultBulkBatchSize)
+	if err != nil {
+		log.Errorw("delete namespace", "requestID", requestid.FromContext(r.Context()), "ns", ns, "roots", res.Roots, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gh-efforts/retrieve-server/metrics"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+)
+
+var (
+	errRootQuota = errors.New("root quota exceeded")
+	errByteQuota = errors.New("storage quota exceeded")
+)
+
+// Quota caps the live roots of a tenant, zero fields are unlimited.
+type Quota struct {
+	MaxRoots int64 `json:"max_roots"`
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// Quotas holds the default quota of every tenant and the ones replacing it,
+// tenants are the identities of the upload tokens.
+type Quotas struct {
+	Default Quota
+	Tenants map[string]Quota
+}
+
+// TenantUsage is what a tenant stores next to its quota.
+type TenantUsage struct {
+	Tenant string `json:"tenant"`
+	Roots  int64  `json:"roots"`
+	Bytes  int64  `json:"bytes"`
+	Quota
+}
+
+// SetQuotas replaces the quotas, uploads already checked are kept.
+func (s *Server) SetQuotas(q Quotas) {
+	s.quotaLk.Lock()
+	defer s.quotaLk.Unlock()
+
+	s.quotas = q
+}
+
+func (s *Server) quota(tenant string) Quota {
+	s.quotaLk.RLock()
+	defer s.quotaLk.RUnlock()
+
+	if q, ok := s.quotas.Tenants[tenant]; ok {
+		return q
+	}
+	return s.quotas.Default
+}
+
+// tenantUsage counts the live roots uploaded by tenant.
+func tenantUsage(ctx context.Context, q querier, tenant string) (roots, bytes int64, err error) {
+	err = q.QueryRowContext(ctx, `SELECT COUNT(*), COALESCE(SUM(size), 0) FROM RootBlocks WHERE uploader=$1 AND deleted_at IS NULL`, tenant).
+		Scan(&roots, &bytes)
+	return roots, bytes, err
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// checkQuota fails when storing root would take tenant over its quota,
+// uploading a root that is already live does not count. On postgres and
+// yugabyte the check locks the TenantLocks row of the tenant until tx ends,
+// so concurrent uploads of one tenant cannot pass it together. sqlite runs
+// one transaction at a time.
+func (s *Server) checkQuota(ctx context.Context, tx *sql.Tx, tenant string, root string, size int) error {
+	q := s.quota(tenant)
+	if q.MaxRoots <= 0 && q.MaxBytes <= 0 {
+		return nil
+	}
+
+	if s.d.DBType != "sqlite" {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO TenantLocks(tenant) VALUES ($1) ON CONFLICT DO NOTHING`, tenant); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `SELECT tenant FROM TenantLocks WHERE tenant=$1 FOR UPDATE`, tenant); err != nil {
+			return err
+		}
+	}
+
+	var live int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM RootBlocks WHERE root=$1 AND deleted_at IS NULL`, root).Scan(&live); err != nil {
+		return err
+	}
+	if live > 0 {
+		return nil
+	}
+
+	roots, bytes, err := tenantUsage(ctx, tx, tenant)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case q.MaxRoots > 0 && roots+1 > q.MaxRoots:
+		recordQuotaRejection(tenant, "roots")
+		return fmt.Errorf("%w: tenant %q stores %d of %d roots", errRootQuota, tenant, roots, q.MaxRoots)
+	case q.MaxBytes > 0 && bytes+int64(size) > q.MaxBytes:
+		recordQuotaRejection(tenant, "bytes")
+		return fmt.Errorf("%w: tenant %q stores %d of %d bytes, block is %d", errByteQuota, tenant, bytes, q.MaxBytes, size)
+	}
+
+	return nil
+}
+
+func recordQuotaRejection(tenant, reason string) {
+	ctx, _ := tag.New(context.Background(), tag.Upsert(metrics.Tenant, tenant), tag.Upsert(metrics.Reason, reason))
+	stats.Record(ctx, metrics.QuotaRejections.M(1))
+}
+
+func (s *Server) usage(ctx context.Context, tenant string) (*TenantUsage, error) {
+	ctx, span := s.startSpan(ctx, "usage", "")
+	stop := s.d.Timer("usage")
+	roots, bytes, err := tenantUsage(ctx, s.d.DB, tenant)
+	stop()
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TenantUsage{
+		Tenant: tenant,
+		Roots:  roots,
+		Bytes:  bytes,
+		Quota:  s.quota(tenant),
+	}, nil
+}
+
+// RecordUsage records the usage of every tenant every interval until ctx
+// is done.
+func (s *Server) RecordUsage(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.recordUsage(ctx); err != nil && ctx.Err() == nil {
+			log.Warnw("record tenant usage", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// recordUsage records the usage of the tenants storing roots, and zero for
+// the ones recorded before which no longer store any.
+func (s *Server) recordUsage(ctx context.Context) error {
+	stop := s.d.Timer("usage_all")
+	defer stop()
+
+	rows, err := s.d.DB.QueryContext(ctx, `SELECT uploader, COUNT(*), COALESCE(SUM(size), 0) FROM RootBlocks WHERE deleted_at IS NULL GROUP BY uploader`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	usage := make(map[string]TenantUsage)
+	for rows.Next() {
+		var u TenantUsage
+		if err := rows.Scan(&u.Tenant, &u.Roots, &u.Bytes); err != nil {
+			return err
+		}
+		usage[u.Tenant] = u
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.usageLk.Lock()
+	defer s.usageLk.Unlock()
+
+	for tenant := range s.usageTenants {
+		if _, ok := usage[tenant]; !ok {
+			usage[tenant] = TenantUsage{Tenant: tenant}
+		}
+	}
+	s.usageTenants = make(map[string]struct{}, len(usage))
+	for tenant, u := range usage {
+		tctx, _ := tag.New(context.Background(), tag.Upsert(metrics.Tenant, tenant))
+		stats.Record(tctx, metrics.TenantRoots.M(u.Roots), metrics.TenantBytes.M(u.Bytes))
+
+		if u.Roots > 0 {
+			s.usageTenants[tenant] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) usageHandle(w http.ResponseWriter, r *http.Request) {
+	u, err := s.usage(r.Context(), r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(u)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	type step struct {
+		tenant   string
+		delete   bool
+		undelete bool
+		data     string
+		err      error
+	}
+	tests := []struct {
+		name   string
+		quotas Quotas
+		steps  []step
+		usage  map[string]int64
+	}{
+		{
+			name:   "roots over quota",
+			quotas: Quotas{Default: Quota{MaxRoots: 1}},
+			steps: []step{
+				{tenant: "alice", data: "a"},
+				{tenant: "alice", data: "b", err: errRootQuota},
+			},
+			usage: map[string]int64{"alice": 1},
+		},
+		{
+			name:   "bytes over quota",
+			quotas: Quotas{Default: Quota{MaxBytes: 10}},
+			steps: []step{
+				{tenant: "alice", data: "aaaaaa"},
+				{tenant: "alice", data: "bbbbbb", err: errByteQuota},
+			},
+			usage: map[string]int64{"alice": 1},
+		},
+		{
+			name:   "tenant quota replaces the default",
+			quotas: Quotas{Default: Quota{MaxRoots: 1}, Tenants: map[string]Quota{"bob": {MaxRoots: 2}}},
+			steps: []step{
+				{tenant: "bob", data: "a"},
+				{tenant: "bob", data: "b"},
+				{tenant: "alice", data: "c"},
+				{tenant: "alice", data: "d", err: errRootQuota},
+			},
+			usage: map[string]int64{"alice": 1, "bob": 2},
+		},
+		{
+			name:   "uploading a live root again is free",
+			quotas: Quotas{Default: Quota{MaxRoots: 1}},
+			steps: []step{
+				{tenant: "alice", data: "a"},
+				{tenant: "alice", data: "a"},
+				{tenant: "bob", data: "a"},
+				{tenant: "bob", data: "b"},
+			},
+			usage: map[string]int64{"alice": 1, "bob": 1},
+		},
+		{
+			name:   "deleted roots free the quota",
+			quotas: Quotas{Default: Quota{MaxRoots: 1}},
+			steps: []step{
+				{tenant: "alice", data: "a"},
+				{tenant: "alice", data: "a", delete: true},
+				{tenant: "alice", data: "b"},
+			},
+			usage: map[string]int64{"alice": 1},
+		},
+		{
+			name:   "revived roots are charged to the new uploader",
+			quotas: Quotas{Default: Quota{MaxRoots: 1}},
+			steps: []step{
+				{tenant: "alice", data: "a"},
+				{tenant: "alice", data: "a", delete: true},
+				{tenant: "bob", data: "a"},
+				{tenant: "alice", data: "b"},
+				{tenant: "bob", data: "c", err: errRootQuota},
+			},
+			usage: map[string]int64{"alice": 1, "bob": 1},
+		},
+		{
+			name:   "undeleted roots are charged again",
+			quotas: Quotas{Default: Quota{MaxRoots: 1}},
+			steps: []step{
+				{tenant: "alice", data: "a"},
+				{tenant: "alice", data: "a", delete: true},
+				{tenant: "alice", data: "b"},
+				{tenant: "alice", data: "a", undelete: true, err: errRootQuota},
+				{tenant: "alice", data: "b", delete: true},
+				{tenant: "alice", data: "a", undelete: true},
+			},
+			usage: map[string]int64{"alice": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Options{Quotas: tt.quotas})
+
+			for i, st := range tt.steps {
+				rb := testBlock(t, st.data)
+
+				var err error
+				switch {
+				case st.delete:
+					err = s.delete(as(st.tenant), "default", rb.Root)
+				case st.undelete:
+					err = s.undelete(as(st.tenant), "default", rb.Root)
+				default:
+					err = s.upsert(as(st.tenant), "default", rb, &upload{source: SourcePost})
+				}
+				if !errors.Is(err, st.err) {
+					t.Fatalf("step %d: err %v, want %v", i, err, st.err)
+				}
+			}
+
+			for tenant, want := range tt.usage {
+				u, err := s.usage(as(tenant), tenant)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if u.Roots != want {
+					t.Fatalf("%s stores %d roots, want %d", tenant, u.Roots, want)
+				}
+			}
+		})
+	}
+}
@@ -1,72 +1,379 @@
 package server
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/gh-efforts/retrieve-server/auth"
 	"github.com/gh-efforts/retrieve-server/db"
+	"github.com/gh-efforts/retrieve-server/metrics"
+	"github.com/gh-efforts/retrieve-server/requestid"
+	"github.com/ipfs/go-cid"
 	logging "github.com/ipfs/go-log/v2"
+	"github.com/multiformats/go-multicodec"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var log = logging.Logger("server")
 
+var tracer = otel.Tracer("github.com/gh-efforts/retrieve-server/server")
+
+const (
+	DefaultMaxBlockSize = 4 << 20
+	DefaultMaxBodySize  = 8 << 20
+	DefaultMaxCarSize   = 128 << 20
+)
+
+// sources of a stored root
+const (
+	SourcePost    = "post"
+	SourceCar     = "car"
+	SourceImport  = "import"
+	SourceMigrate = "migrate"
+)
+
+type Options struct {
+	// MaxBlockSize is the largest root block accepted by any upload endpoint.
+	MaxBlockSize int64
+	// MaxBodySize caps json request bodies, the base64 encoded block must fit in it.
+	MaxBodySize int64
+	// MaxCarSize caps car upload bodies, blocks other than the roots count too.
+	MaxCarSize int64
+	// Quotas limit what each tenant stores.
+	Quotas Quotas
+	// BackupDir holds the online backups, none are taken when it is empty.
+	BackupDir string
+}
+
 type Server struct {
-	d *db.DB
+	d    *db.DB
+	opts Options
+
+	quotaLk sync.RWMutex
+	quotas  Quotas
+
+	// usageTenants are the tenants whose usage was last recorded non zero
+	usageLk      sync.Mutex
+	usageTenants map[string]struct{}
+
+	// blockLk orders the writes to a block store with their transactions
+	// and keeps them out of a backup
+	blockLk sync.Mutex
 }
 
-func New(d *db.DB) *Server {
+func New(d *db.DB, opts Options) *Server {
+	if opts.MaxBlockSize <= 0 {
+		opts.MaxBlockSize = DefaultMaxBlockSize
+	}
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = DefaultMaxBodySize
+	}
+	if opts.MaxCarSize <= 0 {
+		opts.MaxCarSize = DefaultMaxCarSize
+	}
+
 	return &Server{
-		d: d,
+		d:      d,
+		opts:   opts,
+		quotas: opts.Quotas,
 	}
 }
 
-func (s *Server) upsert(rb *RootBlock) error {
+// upsert stores the block of a verified root in ns and the deal of the
+// upload, uploading a stored root again only bumps updated_at so the
+// original uploader and source are kept and revives the root if it was
+// deleted. A revived root belongs to the tenant uploading it, its quota is
+// charged from then on. Blocks are stored once and shared by the
+// namespaces holding them, each namespace has its own expiry which an
+// upload only moves when it sets one.
+func (s *Server) upsert(ctx context.Context, ns string, rb *RootBlock, up *upload) error {
 	var query string
 	switch s.d.DBType {
 	case "sqlite":
-		query = `INSERT OR IGNORE INTO RootBlocks(root, size, block) VALUES (?, ?, ?)`
+		query = `INSERT INTO RootBlocks(root, size, block, created_at, updated_at, uploader, source, codec, multihash)
+			VALUES ($1, $2, $3, $4, $4, $5, $6, $7, $8)
+			ON CONFLICT (root) DO UPDATE SET updated_at = excluded.updated_at,
+				uploader = CASE WHEN deleted_at IS NULL THEN uploader ELSE excluded.uploader END, deleted_at = NULL, deleted_by = ''`
 	case "postgres", "yugabyte":
-		query = `INSERT INTO RootBlocks(root, size, block) VALUES ($1, $2, $3) ON CONFLICT (root) DO UPDATE SET size = $2, block = $3`
+		query = `INSERT INTO RootBlocks(root, size, block, created_at, updated_at, uploader, source, codec, multihash)
+			VALUES ($1, $2, $3, $4, $4, $5, $6, $7, $8)
+			ON CONFLICT (root) DO UPDATE SET size = $2, block = $3, updated_at = $4,
+				uploader = CASE WHEN RootBlocks.deleted_at IS NULL THEN RootBlocks.uploader ELSE $5 END, deleted_at = NULL, deleted_by = ''`
 	default:
 		return fmt.Errorf("unknown db type: %s", s.d.DBType)
 	}
 
-	_, err := s.d.DB.Exec(query, rb.Root, len(rb.Block), rb.Block)
+	codec, mh, err := cidCodecs(rb.Root)
+	if err != nil {
+		return err
+	}
+
+	// blocks of a db with a block store are only kept there
+	block := rb.Block
+	if s.d.Blocks != nil {
+		block = []byte{}
+	}
+
+	ctx, span := s.startSpan(ctx, "upsert", rb.Root)
+	stop := s.d.Timer("upsert")
+	err = s.withBlocksTx(ctx, func(tx *sql.Tx, bb db.BlockBatch) error {
+		now, actor := time.Now().UTC(), auth.IdentityFromContext(ctx)
+		if err := s.checkQuota(ctx, tx, actor, rb.Root, len(rb.Block)); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, query, rb.Root, len(rb.Block), block, now, actor, up.source, codec, mh)
+		if err != nil {
+			return err
+		}
+		if err := bb.Put(ns, rb.Root, rb.Block); err != nil {
+			return err
+		}
+		// a revived root does not keep the expiry it was deleted with
+		_, err = tx.ExecContext(ctx, `INSERT INTO NamespaceRoots(ns, root, created_at, uploader, expires_at) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT (ns, root) DO UPDATE SET
+				uploader = CASE WHEN NamespaceRoots.deleted_at IS NULL THEN NamespaceRoots.uploader ELSE excluded.uploader END,
+				expires_at = CASE WHEN NamespaceRoots.deleted_at IS NULL THEN COALESCE(excluded.expires_at, NamespaceRoots.expires_at) ELSE excluded.expires_at END,
+				deleted_at = NULL`, ns, rb.Root, now, actor, up.expiresAt)
+		if err != nil {
+			return err
+		}
+		if err := audit(ctx, tx, now, ActionUpsert, ns, rb.Root, actor, up.source); err != nil {
+			return err
+		}
+		if up.deal == nil {
+			return nil
+		}
+		return s.addDeal(ctx, tx, rb.Root, up.deal)
+	})
+	stop()
+	endSpan(span, err)
 	if err != nil {
 		return err
 	}
 
-	log.Debugw("upsert", "root", rb.Root, "size", len(rb.Block))
+	recordBlockSize("upsert", len(rb.Block))
+	log.Debugw("upsert", "requestID", requestid.FromContext(ctx), "ns", ns, "root", rb.Root, "size", len(rb.Block), "source", up.source, "deal", up.deal != nil)
 	return nil
 }
 
-func (s *Server) delete(root string) error {
-	_, err := s.d.DB.Exec(`DELETE FROM RootBlocks WHERE root=$1`, root)
+// delete marks root as deleted in ns by the caller, the row and its deals
+// are kept until the reaper purges them so the root can still be undeleted.
+func (s *Server) delete(ctx context.Context, ns string, root string) error {
+	ctx, span := s.startSpan(ctx, "delete", root)
+	stop := s.d.Timer("delete")
+	err := s.withBlocksTx(ctx, func(tx *sql.Tx, bb db.BlockBatch) error {
+		now, actor := time.Now().UTC(), auth.IdentityFromContext(ctx)
+		ok, err := tombstone(ctx, tx, bb, now, actor, ns, root)
+		if err != nil || !ok {
+			return err
+		}
+		return audit(ctx, tx, now, ActionDelete, ns, root, actor, "")
+	})
+	stop()
+	endSpan(span, err)
 	if err != nil {
 		return err
 	}
 
-	log.Debugw("delete", "root", root)
+	log.Debugw("delete", "requestID", requestid.FromContext(ctx), "ns", ns, "root", root)
 	return nil
 }
 
-func (s *Server) block(root string) ([]byte, error) {
+// liveRoot joins the live roots of a namespace, $1 is the namespace and $2
+// the root.
+const liveRoot = `RootBlocks b JOIN NamespaceRoots n ON n.root = b.root
+	WHERE n.ns=$1 AND n.root=$2 AND n.deleted_at IS NULL AND b.deleted_at IS NULL`
+
+func (s *Server) block(ctx context.Context, ns string, root string) ([]byte, error) {
 	var block []byte
-	err := s.d.DB.QueryRow(`SELECT block FROM RootBlocks WHERE root=$1`, root).Scan(&block)
+	ctx, span := s.startSpan(ctx, "block", root)
+	stop := s.d.Timer("block")
+	var err error
+	if s.d.Blocks != nil {
+		block, err = s.d.Blocks.Block(ns, root)
+	} else {
+		err = s.d.DB.QueryRowContext(ctx, `SELECT b.block FROM `+liveRoot, ns, root).Scan(&block)
+	}
+	stop()
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Debugw("getblock", "root", root, "size", len(block))
+	recordBlockSize("block", len(block))
+	log.Debugw("getblock", "requestID", requestid.FromContext(ctx), "ns", ns, "root", root, "size", len(block))
 	return block, nil
 }
 
-func (s *Server) size(root string) (int, error) {
+func (s *Server) size(ctx context.Context, ns string, root string) (int, error) {
 	var size int
-	err := s.d.DB.QueryRow(`SELECT size FROM RootBlocks WHERE root=$1`, root).Scan(&size)
+	ctx, span := s.startSpan(ctx, "size", root)
+	stop := s.d.Timer("size")
+	var err error
+	if s.d.Blocks != nil {
+		size, err = s.d.Blocks.Size(ns, root)
+	} else {
+		err = s.d.DB.QueryRowContext(ctx, `SELECT b.size FROM `+liveRoot, ns, root).Scan(&size)
+	}
+	stop()
+	endSpan(span, err)
 	if err != nil {
 		return 0, err
 	}
 
-	log.Debugw("getsize", "root", root, "size", size)
+	log.Debugw("getsize", "requestID", requestid.FromContext(ctx), "ns", ns, "root", root, "size", size)
 	return size, nil
 }
+
+func (s *Server) meta(ctx context.Context, root string) (*RootMeta, error) {
+	var m RootMeta
+	var createdAt, updatedAt, deletedAt sql.NullTime
+	ctx, span := s.startSpan(ctx, "meta", root)
+	stop := s.d.Timer("meta")
+	err := s.d.DB.QueryRowContext(ctx, `SELECT root, size, created_at, updated_at, deleted_at, deleted_by, uploader, source, codec, multihash FROM RootBlocks WHERE root=$1`, root).
+		Scan(&m.Root, &m.Size, &createdAt, &updatedAt, &deletedAt, &m.DeletedBy, &m.Uploader, &m.Source, &m.Codec, &m.Multihash)
+	stop()
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	if createdAt.Valid {
+		m.CreatedAt = &createdAt.Time
+	}
+	if updatedAt.Valid {
+		m.UpdatedAt = &updatedAt.Time
+	}
+	if deletedAt.Valid {
+		m.DeletedAt = &deletedAt.Time
+	}
+	// rows stored before the columns existed, the root carries both
+	if m.Codec == "" {
+		m.Codec, m.Multihash, _ = cidCodecs(root)
+	}
+
+	m.Deals, err = s.queryDeals(ctx, `SELECT root, piece_cid, deal_id, provider, sector, piece_offset FROM RootDeals WHERE root=$1 ORDER BY piece_cid`, root)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Namespaces, m.ExpiresAt, err = s.rootNamespaces(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugw("getmeta", "requestID", requestid.FromContext(ctx), "root", root)
+	return &m, nil
+}
+
+// rootNamespaces lists the namespaces holding root and when root expires
+// from the last of them, nil when one of them keeps it.
+func (s *Server) rootNamespaces(ctx context.Context, root string) ([]string, *time.Time, error) {
+	rows, err := s.d.DB.QueryContext(ctx, `SELECT ns, expires_at FROM NamespaceRoots WHERE root=$1 AND deleted_at IS NULL ORDER BY ns`, root)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var namespaces []string
+	var last *time.Time
+	keep := false
+	for rows.Next() {
+		var ns string
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&ns, &expiresAt); err != nil {
+			return nil, nil, err
+		}
+		namespaces = append(namespaces, ns)
+
+		switch {
+		case !expiresAt.Valid:
+			keep = true
+		case last == nil || expiresAt.Time.After(*last):
+			last = &expiresAt.Time
+		}
+	}
+	if keep {
+		last = nil
+	}
+
+	return namespaces, last, rows.Err()
+}
+
+// withTx runs fn in a transaction, committing it when fn succeeds.
+func (s *Server) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return s.withBlocksTx(ctx, func(tx *sql.Tx, _ db.BlockBatch) error {
+		return fn(tx)
+	})
+}
+
+// withBlocksTx runs fn like withTx and writes the block store changes fn
+// adds to bb once the transaction committed, bb does nothing unless the db
+// has a block store. A crash between the two commits leaves the block store
+// behind the sql db, uploading or deleting the root again brings them in
+// line.
+func (s *Server) withBlocksTx(ctx context.Context, fn func(tx *sql.Tx, bb db.BlockBatch) error) error {
+	if s.d.Blocks != nil {
+		s.blockLk.Lock()
+		defer s.blockLk.Unlock()
+	}
+
+	tx, err := s.d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	bb := s.d.Batch()
+	defer bb.Close()
+
+	if err := fn(tx, bb); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return bb.Commit()
+}
+
+// cidCodecs returns the names of the codec and multihash of root.
+func cidCodecs(root string) (string, string, error) {
+	c, err := cid.Parse(root)
+	if err != nil {
+		return "", "", err
+	}
+
+	prefix := c.Prefix()
+	return multicodec.Code(prefix.Codec).String(), multicodec.Code(prefix.MhType).String(), nil
+}
+
+func recordBlockSize(op string, size int) {
+	ctx, _ := tag.New(context.Background(), tag.Upsert(metrics.Operation, op))
+	stats.Record(ctx, metrics.BlockSize.M(int64(size)))
+}
+
+// startSpan starts the span of a db call, op is also the name of its
+// query duration metric.
+func (s *Server) startSpan(ctx context.Context, op string, root string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "db."+op, trace.WithAttributes(
+		attribute.String("db.system", s.d.DBType),
+		attribute.String("root", root),
+	))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
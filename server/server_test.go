@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/gh-efforts/retrieve-server/auth"
+	"github.com/gh-efforts/retrieve-server/db"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// newTestServer returns a server on a new sqlite db.
+func newTestServer(t *testing.T, opts Options) *Server {
+	t.Helper()
+	return openTestServer(t, filepath.Join(t.TempDir(), "test.db"), opts)
+}
+
+// openTestServer returns a server on the db at dbPath.
+func openTestServer(t *testing.T, dbPath string, opts Options) *Server {
+	t.Helper()
+
+	d, err := db.OpenDB(dbPath, db.Options{AutoMigrate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+
+	return New(d, opts)
+}
+
+// backends are the db backends tests run against.
+var backends = []string{"sqlite", "pebble", "flatfs"}
+
+// testDBPath returns a new db path of backend.
+func testDBPath(t *testing.T, backend string) string {
+	switch backend {
+	case "pebble", "flatfs":
+		return backend + "://" + t.TempDir()
+	default:
+		return filepath.Join(t.TempDir(), "test.db")
+	}
+}
+
+// testBlock returns data as a raw root block.
+func testBlock(t *testing.T, data string) *RootBlock {
+	t.Helper()
+
+	mh, err := multihash.Sum([]byte(data), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &RootBlock{Root: cid.NewCidV1(cid.Raw, mh).String(), Block: []byte(data)}
+}
+
+// as returns a context authenticated as tenant.
+func as(tenant string) context.Context {
+	return auth.NewContext(context.Background(), tenant)
+}
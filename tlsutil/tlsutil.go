@@ -0,0 +1,163 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+var log = logging.Logger("tlsutil")
+
+// Reloader holds a certificate/key pair, and the CA bundle client
+// certificates are verified against, that can be reloaded from disk while
+// the listener keeps running.
+type Reloader struct {
+	lk       sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+
+	clientCAFile string
+	clientCAs    *x509.CertPool
+}
+
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{}
+	if err := r.SetFiles(certFile, keyFile); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads the certificate, key and client CA bundle again, the old
+// ones are kept on error.
+func (r *Reloader) Reload() error {
+	r.lk.RLock()
+	certFile, keyFile, clientCAFile := r.certFile, r.keyFile, r.clientCAFile
+	r.lk.RUnlock()
+
+	if err := r.SetFiles(certFile, keyFile); err != nil {
+		return err
+	}
+	if clientCAFile != "" {
+		return r.SetClientCA(clientCAFile)
+	}
+	return nil
+}
+
+// SetFiles loads the pair from new paths, the old files and pair are kept
+// on error.
+func (r *Reloader) SetFiles(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("load key pair: %w", err)
+	}
+
+	r.lk.Lock()
+	r.certFile, r.keyFile = certFile, keyFile
+	r.cert = &cert
+	r.lk.Unlock()
+
+	log.Infow("loaded certificate", "cert", certFile, "key", keyFile)
+	return nil
+}
+
+// SetClientCA loads the CA bundle client certificates are verified against
+// from a new path, the old bundle is kept on error. It only takes effect on
+// listeners whose ServerConfig was given a client CA.
+func (r *Reloader) SetClientCA(caFile string) error {
+	pool, err := LoadCertPool(caFile)
+	if err != nil {
+		return err
+	}
+
+	r.lk.Lock()
+	r.clientCAFile = caFile
+	r.clientCAs = pool
+	r.lk.Unlock()
+
+	log.Infow("loaded client CA", "ca", caFile)
+	return nil
+}
+
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+	return r.cert, nil
+}
+
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+	return r.cert, nil
+}
+
+// ServerConfig returns a tls config for a listener, client certificates are
+// required and verified against clientCAFile when it is set. Handshakes use
+// the CA bundle r holds at the time, so reloading r rotates it.
+func ServerConfig(r *Reloader, clientCAFile string) (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+
+	if clientCAFile != "" {
+		if err := r.SetClientCA(clientCAFile); err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = r.clientCAs
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+		conf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := conf.Clone()
+			c.GetConfigForClient = nil
+
+			r.lk.RLock()
+			c.ClientCAs = r.clientCAs
+			r.lk.RUnlock()
+			return c, nil
+		}
+	}
+
+	return conf, nil
+}
+
+// ClientConfig returns a tls config for dialing a server, caFile replaces the
+// system roots when it is set and r is presented as the client certificate.
+func ClientConfig(caFile string, r *Reloader) (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pool, err := LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+
+	if r != nil {
+		conf.GetClientCertificate = r.GetClientCertificate
+	}
+
+	return conf, nil
+}
+
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return pool, nil
+}